@@ -1,10 +1,54 @@
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
 type APIResponse struct {
-	IsBanned      string
-	VACChecked    string
-	VACBanned     string
-	ByPassCountry string
-	ByPassVAC     string
+	IsBanned      Flag
+	VACChecked    Flag
+	VACBanned     Flag
+	ByPassCountry Flag
+	ByPassVAC     Flag
 	SteamId       string
 }
+
+// Flag is a yes/no field. The web panel sends "1"/"0" strings, numbers
+// and booleans are accepted as well.
+type Flag bool
+
+func (f *Flag) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		*f = false
+	case bool:
+		*f = Flag(v)
+	case float64:
+		*f = v != 0
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "1", "true", "yes":
+			*f = true
+		case "", "0", "false", "no":
+			*f = false
+		default:
+			return fmt.Errorf("invalid flag (%s)", v)
+		}
+	default:
+		return fmt.Errorf("invalid flag (%s)", data)
+	}
+	return nil
+}
+
+func (f Flag) MarshalJSON() ([]byte, error) {
+	if f {
+		return []byte(`"1"`), nil
+	}
+	return []byte(`"0"`), nil
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout          = 3 * time.Second
+	DefaultRetries          = 2
+	DefaultRetryDelay       = 250 * time.Millisecond
+	DefaultCacheTTL         = 10 * time.Minute
+	DefaultNegativeTTL      = time.Minute
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+
+	maxBody  = 64 * 1024
+	maxCache = 4096 // entries before expired ones are swept
+)
+
+// ErrBreakerOpen is returned without asking the player api while it is
+// considered down.
+var ErrBreakerOpen = errors.New("player api unavailable (circuit breaker open)")
+
+// Options tune the client. Durations are in seconds unless noted, zero
+// picks the default.
+type Options struct {
+	Timeout          int // per request
+	Retries          int // requests after the first one
+	RetryDelay       int // milliseconds before the first retry, doubled for every further one
+	CacheTTL         int // how long a record is reused
+	NegativeTTL      int // how long a GUID unknown to the player api is remembered
+	BreakerThreshold int // failed lookups in a row that stop all requests
+	BreakerCooldown  int // how long requests stay stopped before one is tried again
+}
+
+// Client looks up players in the player api. Records are cached per GUID,
+// failed requests are retried and after repeated failures the api is left
+// alone for a while so that joins are not held up by a dead web panel.
+type Client struct {
+	url  string
+	http *http.Client
+
+	timeout     time.Duration
+	retries     int
+	retryDelay  time.Duration
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	threshold   int
+	cooldown    time.Duration
+
+	mutex *sync.Mutex
+	cache map[string]entry
+	calls map[string]*call
+
+	// circuit breaker
+	failures int
+	until    time.Time // no requests before
+	probing  bool      // a single request tests whether the api is back
+}
+
+type entry struct {
+	record  *APIResponse // nil if the GUID is unknown
+	expires time.Time
+}
+
+// call is a lookup in progress, concurrent lookups of a GUID share it.
+type call struct {
+	done   chan struct{}
+	record *APIResponse
+	err    error
+}
+
+// NewClient returns a client for rawurl, %s in it is replaced by the GUID.
+func NewClient(rawurl string, o Options) *Client {
+	seconds := func(n int, def time.Duration) time.Duration {
+		if n <= 0 {
+			return def
+		}
+		return time.Duration(n) * time.Second
+	}
+	c := &Client{
+		url:         rawurl,
+		http:        &http.Client{},
+		timeout:     seconds(o.Timeout, DefaultTimeout),
+		retries:     o.Retries,
+		retryDelay:  time.Duration(o.RetryDelay) * time.Millisecond,
+		cacheTTL:    seconds(o.CacheTTL, DefaultCacheTTL),
+		negativeTTL: seconds(o.NegativeTTL, DefaultNegativeTTL),
+		threshold:   o.BreakerThreshold,
+		cooldown:    seconds(o.BreakerCooldown, DefaultBreakerCooldown),
+		mutex:       &sync.Mutex{},
+		cache:       make(map[string]entry),
+		calls:       make(map[string]*call),
+	}
+	if c.retries <= 0 {
+		c.retries = DefaultRetries
+	}
+	if c.retryDelay <= 0 {
+		c.retryDelay = DefaultRetryDelay
+	}
+	if c.threshold <= 0 {
+		c.threshold = DefaultBreakerThreshold
+	}
+	return c
+}
+
+// Lookup returns the record of guid, nil if the player api does not know
+// the GUID. An error means the player api could not be asked or gave no
+// usable answer; the caller decides whether to let the player in.
+func (c *Client) Lookup(ctx context.Context, guid string) (*APIResponse, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	if e, ok := c.cache[guid]; ok && now.Before(e.expires) {
+		c.mutex.Unlock()
+		return e.record, nil
+	}
+	if cl, ok := c.calls[guid]; ok {
+		c.mutex.Unlock()
+		select {
+		case <-cl.done:
+			return cl.record, cl.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !c.allow(now) {
+		c.mutex.Unlock()
+		return nil, ErrBreakerOpen
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[guid] = cl
+	c.mutex.Unlock()
+
+	record, found, err := c.fetch(ctx, guid)
+
+	now = time.Now()
+	c.mutex.Lock()
+	delete(c.calls, guid)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// given up by the caller, says nothing about the api
+		c.probing = false
+	case err != nil:
+		c.failed(now)
+	default:
+		c.failures = 0
+		c.probing = false
+		ttl := c.cacheTTL
+		if !found {
+			record = nil
+			ttl = c.negativeTTL
+		}
+		c.store(guid, entry{record: record, expires: now.Add(ttl)}, now)
+	}
+	c.mutex.Unlock()
+
+	cl.record, cl.err = record, err
+	close(cl.done)
+	return record, err
+}
+
+// Forget drops the cached record of guid.
+func (c *Client) Forget(guid string) {
+	c.mutex.Lock()
+	delete(c.cache, guid)
+	c.mutex.Unlock()
+}
+
+// Available reports whether requests are let through to the player api.
+func (c *Client) Available() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.failures < c.threshold || !time.Now().Before(c.until)
+}
+
+// allow decides whether a request may be sent. The caller holds the mutex.
+func (c *Client) allow(now time.Time) bool {
+	if c.failures < c.threshold {
+		return true
+	}
+	if now.Before(c.until) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// failed counts a failed lookup and opens the breaker once there are too
+// many in a row. The caller holds the mutex.
+func (c *Client) failed(now time.Time) {
+	c.failures++
+	c.probing = false
+	if c.failures >= c.threshold {
+		c.until = now.Add(c.cooldown)
+	}
+}
+
+// store caches an entry and sweeps expired ones once the cache has grown.
+// The caller holds the mutex.
+func (c *Client) store(guid string, e entry, now time.Time) {
+	if len(c.cache) >= maxCache {
+		for g, old := range c.cache {
+			if !now.Before(old.expires) {
+				delete(c.cache, g)
+			}
+		}
+	}
+	c.cache[guid] = e
+}
+
+// fetch asks the player api, retrying with backoff as long as the error
+// may go away.
+func (c *Client) fetch(ctx context.Context, guid string) (*APIResponse, bool, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		record, found, retry, err := c.get(ctx, guid)
+		if err == nil || !retry || attempt >= c.retries {
+			return record, found, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, false, err
+		}
+		delay *= 2
+	}
+}
+
+// get sends a single request. Timeouts, network errors and server errors
+// are worth a retry.
+func (c *Client) get(ctx context.Context, guid string) (*APIResponse, bool, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", fmt.Sprintf(c.url, url.QueryEscape(guid)), nil)
+	if err != nil {
+		return nil, false, false, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, false, ctx.Err() == nil || ctx.Err() == context.DeadlineExceeded, fmt.Errorf("player api: %v", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, false, true, fmt.Errorf("player api: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, false, fmt.Errorf("player api: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, false, true, fmt.Errorf("player api: %v", err)
+	}
+	var record APIResponse
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, false, false, fmt.Errorf("player api: invalid record: %v", err)
+	}
+	return &record, true, false, nil
+}
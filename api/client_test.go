@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, o Options) (*Mock, *Client) {
+	mock := NewMock()
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	return mock, NewClient(server.URL+"/?BattlEyeGUID=%s", o)
+}
+
+func TestClientCache(t *testing.T) {
+	mock, client := newTestClient(t, Options{})
+	mock.Set("a", APIResponse{IsBanned: true, SteamId: "7"})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		record, err := client.Lookup(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record == nil || !bool(record.IsBanned) || record.SteamId != "7" {
+			t.Fatalf("got %+v", record)
+		}
+	}
+	if mock.Calls() != 1 {
+		t.Errorf("%d requests for a cached record", mock.Calls())
+	}
+
+	mock.Set("a", APIResponse{})
+	client.Forget("a")
+	record, err := client.Lookup(ctx, "a")
+	if err != nil || record == nil || bool(record.IsBanned) {
+		t.Errorf("after Forget got %+v, %v", record, err)
+	}
+	if mock.Calls() != 2 {
+		t.Errorf("%d requests after Forget, want 2", mock.Calls())
+	}
+}
+
+func TestClientNegativeCache(t *testing.T) {
+	mock, client := newTestClient(t, Options{NegativeTTL: 1})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		record, err := client.Lookup(ctx, "unknown")
+		if record != nil || err != nil {
+			t.Fatalf("got %+v, %v for an unknown GUID", record, err)
+		}
+	}
+	if mock.Calls() != 1 {
+		t.Errorf("%d requests for an unknown GUID", mock.Calls())
+	}
+
+	mock.Set("unknown", APIResponse{VACBanned: true})
+	time.Sleep(1100 * time.Millisecond)
+	record, err := client.Lookup(ctx, "unknown")
+	if err != nil || record == nil || !bool(record.VACBanned) {
+		t.Errorf("after the negative TTL got %+v, %v", record, err)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	mock, client := newTestClient(t, Options{Retries: 1, RetryDelay: 1, BreakerThreshold: 2, BreakerCooldown: 1})
+	mock.Set("a", APIResponse{})
+	mock.SetStatus(http.StatusServiceUnavailable)
+	ctx := context.Background()
+
+	for _, guid := range []string{"a", "b"} {
+		if _, err := client.Lookup(ctx, guid); err == nil || err == ErrBreakerOpen {
+			t.Fatalf("%s: got %v, want the server error", guid, err)
+		}
+	}
+	// each lookup is tried twice
+	if mock.Calls() != 4 {
+		t.Errorf("%d requests, want 4", mock.Calls())
+	}
+	if client.Available() {
+		t.Error("available after repeated failures")
+	}
+	if _, err := client.Lookup(ctx, "a"); err != ErrBreakerOpen {
+		t.Errorf("got %v, want ErrBreakerOpen", err)
+	}
+	if mock.Calls() != 4 {
+		t.Errorf("%d requests while the breaker is open", mock.Calls())
+	}
+
+	mock.SetStatus(0)
+	time.Sleep(1100 * time.Millisecond)
+	if !client.Available() {
+		t.Error("not available after the cooldown")
+	}
+	if record, err := client.Lookup(ctx, "a"); err != nil || record == nil {
+		t.Fatalf("probe got %+v, %v", record, err)
+	}
+	if _, err := client.Lookup(ctx, "b"); err != nil {
+		t.Errorf("after recovery got %v", err)
+	}
+}
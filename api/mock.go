@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Mock is an in-memory player api for tests. It answers like StandInHandler
+// except that unknown GUIDs are not found, and it can be slowed down or
+// made to fail.
+type Mock struct {
+	mutex   *sync.Mutex
+	records map[string]APIResponse
+	delay   time.Duration
+	status  int
+	calls   int
+}
+
+func NewMock() *Mock {
+	return &Mock{mutex: &sync.Mutex{}, records: make(map[string]APIResponse)}
+}
+
+// Set stores the record of guid.
+func (m *Mock) Set(guid string, record APIResponse) {
+	m.mutex.Lock()
+	m.records[guid] = record
+	m.mutex.Unlock()
+}
+
+// Delete removes the record of guid.
+func (m *Mock) Delete(guid string) {
+	m.mutex.Lock()
+	delete(m.records, guid)
+	m.mutex.Unlock()
+}
+
+// SetDelay holds every answer back by d.
+func (m *Mock) SetDelay(d time.Duration) {
+	m.mutex.Lock()
+	m.delay = d
+	m.mutex.Unlock()
+}
+
+// SetStatus answers every request with an error status, 0 answers
+// normally again.
+func (m *Mock) SetStatus(code int) {
+	m.mutex.Lock()
+	m.status = code
+	m.mutex.Unlock()
+}
+
+// Calls returns the number of requests served so far.
+func (m *Mock) Calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
+
+func (m *Mock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	m.calls++
+	delay, status := m.delay, m.status
+	m.mutex.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	guid, ok := guidParam(w, r)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	record, ok := m.records[guid]
+	m.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeRecord(w, record)
+}
@@ -0,0 +1,305 @@
+package bans
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Ban struct {
+	ID      uint64
+	GUID    string
+	IP      string // banned if there is no GUID, otherwise only for information
+	Name    string // player name at ban time
+	Reason  string
+	Issuer  string // admin or rule
+	Origin  string // server the ban was issued on, empty for this one
+	Created time.Time
+	Expires time.Time // zero for permanent bans
+	Listed  bool      // seen on the BattlEye bans list, see Syncer
+}
+
+func (b *Ban) Permanent() bool {
+	return b.Expires.IsZero()
+}
+
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.Permanent() && !now.Before(b.Expires)
+}
+
+// Remaining returns the time left, or 0 for permanent bans.
+func (b *Ban) Remaining(now time.Time) time.Duration {
+	if b.Permanent() {
+		return 0
+	}
+	return b.Expires.Sub(now)
+}
+
+// banIP returns the IP of an IP ban, empty for GUID bans.
+func (b *Ban) banIP() string {
+	if b.GUID != "" {
+		return ""
+	}
+	return b.IP
+}
+
+func (b *Ban) String() string {
+	until := "permanent"
+	if !b.Permanent() {
+		until = "until " + b.Expires.Format("2006-01-02 15:04")
+	}
+	issuer := b.Issuer
+	if b.Origin != "" {
+		issuer += "@" + b.Origin
+	}
+	return fmt.Sprintf("#%d %s %s %q by %s: %s (%s)", b.ID, b.GUID, b.IP, b.Name, issuer, b.Reason, until)
+}
+
+// Tombstone remembers a removed ban until the removal has been pushed
+// to BattlEye, so the next sync does not import it again.
+type Tombstone struct {
+	GUID    string
+	IP      string
+	Removed time.Time
+}
+
+// Lift remembers an imported ban removed on this server for as long as
+// its origin still exports it, so the federation does not import it
+// again. BattlEye syncs leave it alone.
+type Lift struct {
+	Origin  string
+	GUID    string
+	IP      string
+	Removed time.Time
+}
+
+type database struct {
+	NextID  uint64
+	Bans    []*Ban
+	Removed []Tombstone
+	Lifted  []Lift
+}
+
+// Store is a ban database persisted as a json file. Every change is
+// written to disk before it returns. It is safe for concurrent use.
+type Store struct {
+	filename string
+	db       database
+	mutex    *sync.RWMutex
+}
+
+// Open loads the database, creating an empty one if the file does not
+// exist yet.
+func Open(filename string) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		db:       database{NextID: 1},
+		mutex:    &sync.RWMutex{},
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.db); err != nil {
+		return nil, fmt.Errorf("ban database error (%s): %v", filename, err)
+	}
+	return s, nil
+}
+
+// Add stores a new ban and returns it with ID and creation time set.
+func (s *Store) Add(b Ban) (Ban, error) {
+	if b.GUID == "" && b.IP == "" {
+		return b, fmt.Errorf("ban needs a GUID or an IP")
+	}
+	b.GUID = strings.ToLower(b.GUID)
+	if b.Created.IsZero() {
+		b.Created = time.Now()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clearTombstone(b.GUID, b.banIP())
+	b.ID = s.db.NextID
+	s.db.NextID++
+	s.db.Bans = append(s.db.Bans, &b)
+	return b, s.save()
+}
+
+func (s *Store) Remove(id uint64) (Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, b := range s.db.Bans {
+		if b.ID == id {
+			s.db.Bans = append(s.db.Bans[:i], s.db.Bans[i+1:]...)
+			s.db.Removed = append(s.db.Removed, Tombstone{GUID: b.GUID, IP: b.banIP(), Removed: time.Now()})
+			if b.Origin != "" {
+				s.db.Lifted = append(s.db.Lifted, Lift{Origin: b.Origin, GUID: b.GUID, IP: b.banIP(), Removed: time.Now()})
+			}
+			return *b, s.save()
+		}
+	}
+	return Ban{}, fmt.Errorf("no ban #%d", id)
+}
+
+// MarkListed records that bans are on the BattlEye bans list.
+func (s *Store) MarkListed(ids ...uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for _, b := range s.db.Bans {
+		for _, id := range ids {
+			if b.ID == id && !b.Listed {
+				b.Listed = true
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// Find returns the active ban matching the GUID, or the IP of a ban
+// without a GUID.
+func (s *Store) Find(guid, ip string, now time.Time) (Ban, bool) {
+	guid = strings.ToLower(guid)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, b := range s.db.Bans {
+		if b.Expired(now) {
+			continue
+		}
+		if (guid != "" && b.GUID == guid) || (ip != "" && b.banIP() == ip) {
+			return *b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// List returns a copy of all bans ordered by ID.
+func (s *Store) List() []Ban {
+	s.mutex.RLock()
+	list := make([]Ban, 0, len(s.db.Bans))
+	for _, b := range s.db.Bans {
+		list = append(list, *b)
+	}
+	s.mutex.RUnlock()
+	sort.Sort(byID(list))
+	return list
+}
+
+// Expire removes and returns all temporary bans that have run out.
+func (s *Store) Expire(now time.Time) ([]Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var lifted []Ban
+	active := s.db.Bans[:0]
+	for _, b := range s.db.Bans {
+		if b.Expired(now) {
+			lifted = append(lifted, *b)
+		} else {
+			active = append(active, b)
+		}
+	}
+	s.db.Bans = active
+	if len(lifted) == 0 {
+		return nil, nil
+	}
+	return lifted, s.save()
+}
+
+// Tombstones returns the bans removed since the last sync.
+func (s *Store) Tombstones() []Tombstone {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]Tombstone(nil), s.db.Removed...)
+}
+
+// ClearTombstone forgets a removal once it has been pushed to BattlEye.
+func (s *Store) ClearTombstone(guid, ip string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.clearTombstone(guid, ip) {
+		return nil
+	}
+	return s.save()
+}
+
+// IsLifted reports whether a ban exported by origin has been removed on
+// this server.
+func (s *Store) IsLifted(origin string, b Ban) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, l := range s.db.Lifted {
+		if l.Origin == origin && sameBan(Ban{GUID: l.GUID, IP: l.IP}, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearLifted forgets the removals of bans origin no longer exports.
+func (s *Store) ClearLifted(origin string, exported []Ban) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lifted := s.db.Lifted[:0]
+	for _, l := range s.db.Lifted {
+		if l.Origin != origin || listed(exported, Ban{GUID: l.GUID, IP: l.IP}) {
+			lifted = append(lifted, l)
+		}
+	}
+	if len(lifted) == len(s.db.Lifted) {
+		return nil
+	}
+	s.db.Lifted = lifted
+	return s.save()
+}
+
+// clearTombstone reports whether a tombstone was dropped. Callers must
+// hold the write lock.
+func (s *Store) clearTombstone(guid, ip string) bool {
+	guid = strings.ToLower(guid)
+	removed := s.db.Removed[:0]
+	found := false
+	for _, t := range s.db.Removed {
+		if (guid != "" && t.GUID == guid) || (ip != "" && t.IP == ip) {
+			found = true
+			continue
+		}
+		removed = append(removed, t)
+	}
+	s.db.Removed = removed
+	return found
+}
+
+// save writes the database atomically. Callers must hold the write lock.
+func (s *Store) save() error {
+	content, err := json.MarshalIndent(&s.db, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0700); err != nil {
+		return err
+	}
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+type byID []Ban
+
+func (l byID) Len() int           { return len(l) }
+func (l byID) Less(i, j int) bool { return l[i].ID < l[j].ID }
+func (l byID) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
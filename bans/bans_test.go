@@ -0,0 +1,40 @@
+package bans
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFind(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const guid = "0123456789abcdef0123456789abcdef"
+	if _, err := store.Add(Ban{GUID: guid, IP: "203.0.113.7", Reason: "cheating"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(Ban{IP: "198.51.100.1", Reason: "spam"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		guid, ip string
+		want     bool
+	}{
+		{"0123456789ABCDEF0123456789ABCDEF", "", true},
+		{guid, "192.0.2.1", true},
+		// the IP of a GUID ban is only recorded
+		{"ffffffffffffffffffffffffffffffff", "203.0.113.7", false},
+		{"ffffffffffffffffffffffffffffffff", "198.51.100.1", true},
+		{"", "198.51.100.1", true},
+		{"", "192.0.2.1", false},
+	}
+	for _, test := range tests {
+		if _, got := store.Find(test.guid, test.ip, now); got != test.want {
+			t.Errorf("Find(%q, %q) = %t, want %t", test.guid, test.ip, got, test.want)
+		}
+	}
+}
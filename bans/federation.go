@@ -0,0 +1,361 @@
+package bans
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared is the format of a shared ban list: the exported bans of every
+// server, keyed by server name.
+type Shared struct {
+	Servers map[string]*Export
+}
+
+type Export struct {
+	Updated time.Time
+	Bans    []Ban
+}
+
+// Source is a shared ban list and how far it is trusted.
+type Source struct {
+	Name          string
+	Location      string   // file path or http(s) url
+	Import        bool     // take over bans of other servers
+	Export        bool     // publish the bans of this server
+	Unbans        bool     // lift imported bans once their origin drops them
+	PermanentOnly bool     // ignore temporary bans
+	Servers       []string // origins accepted for import, empty accepts all
+	Token         string   // sent when publishing to an http(s) location
+}
+
+func (s *Source) remote() bool {
+	return strings.HasPrefix(s.Location, "http://") || strings.HasPrefix(s.Location, "https://")
+}
+
+func (s *Source) trusts(origin string) bool {
+	if len(s.Servers) == 0 {
+		return true
+	}
+	for _, v := range s.Servers {
+		if v == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Federation exchanges bans between servers through shared ban lists.
+// Only bans issued on this server are exported; imported bans keep the
+// name of the server they came from in Ban.Origin.
+type Federation struct {
+	Self    string // name of this server
+	Store   *Store
+	Sources []Source
+	Client  *http.Client
+}
+
+// Sync imports from and exports to every source and returns a log line
+// per change.
+func (f *Federation) Sync() ([]string, error) {
+	var lines []string
+	var errs []string
+	for i := range f.Sources {
+		src := &f.Sources[i]
+		l, err := f.sync(src)
+		lines = append(lines, l...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return lines, fmt.Errorf("ban federation: %s", strings.Join(errs, "; "))
+	}
+	return lines, nil
+}
+
+func (f *Federation) sync(src *Source) ([]string, error) {
+	var lines []string
+	if src.Import {
+		shared, err := f.fetch(src)
+		if err != nil {
+			return lines, err
+		}
+		lines, err = f.merge(src, shared)
+		if err != nil {
+			return lines, err
+		}
+	}
+	if src.Export {
+		export := f.export()
+		if err := f.publish(src, export); err != nil {
+			return lines, err
+		}
+	}
+	return lines, nil
+}
+
+// merge imports the trusted bans of a shared list into the store.
+func (f *Federation) merge(src *Source, shared *Shared) ([]string, error) {
+	var lines []string
+	now := time.Now()
+	for origin, export := range shared.Servers {
+		// peers are not trusted to send well formed lists
+		if export == nil || origin == f.Self || !src.trusts(origin) {
+			continue
+		}
+		for _, b := range export.Bans {
+			if b.GUID == "" && b.IP == "" {
+				lines = append(lines, fmt.Sprintf("skipped from %s: ban of %s without GUID or IP (%s)", src.Name, origin, b.Reason))
+				continue
+			}
+			if b.Expired(now) || (src.PermanentOnly && !b.Permanent()) {
+				continue
+			}
+			if _, ok := f.Store.Find(b.GUID, b.IP, now); ok || f.Store.IsLifted(origin, b) {
+				continue
+			}
+			b.Origin = origin
+			b.Listed = false
+			b, err := f.Store.Add(b)
+			if err != nil {
+				return lines, err
+			}
+			lines = append(lines, fmt.Sprintf("imported from %s: %s", src.Name, b.String()))
+		}
+		if src.Unbans {
+			for _, b := range f.Store.List() {
+				if b.Origin != origin || listed(export.Bans, b) {
+					continue
+				}
+				if _, err := f.Store.Remove(b.ID); err != nil {
+					return lines, err
+				}
+				lines = append(lines, fmt.Sprintf("lifted by %s: %s", src.Name, b.String()))
+			}
+		}
+		if err := f.Store.ClearLifted(origin, export.Bans); err != nil {
+			return lines, err
+		}
+	}
+	return lines, nil
+}
+
+func listed(list []Ban, b Ban) bool {
+	for _, v := range list {
+		if sameBan(v, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameBan reports whether two bans are for the same GUID, or for the
+// same IP if neither has a GUID.
+func sameBan(a, b Ban) bool {
+	if a.GUID != "" || b.GUID != "" {
+		return strings.EqualFold(a.GUID, b.GUID)
+	}
+	return a.IP != "" && a.IP == b.IP
+}
+
+// export returns the active bans issued on this server.
+func (f *Federation) export() *Export {
+	now := time.Now()
+	export := &Export{Updated: now, Bans: []Ban{}}
+	for _, b := range f.Store.List() {
+		if b.Origin != "" || b.Expired(now) {
+			continue
+		}
+		b.ID = 0
+		b.Listed = false
+		export.Bans = append(export.Bans, b)
+	}
+	return export
+}
+
+func (f *Federation) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (f *Federation) fetch(src *Source) (*Shared, error) {
+	if !src.remote() {
+		return readShared(src.Location)
+	}
+	resp, err := f.client().Get(src.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", src.Location, resp.Status)
+	}
+	var shared Shared
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxShared)).Decode(&shared); err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", src.Location, err)
+	}
+	return &shared, nil
+}
+
+func (f *Federation) publish(src *Source, export *Export) error {
+	if !src.remote() {
+		sharedMutex.Lock()
+		defer sharedMutex.Unlock()
+		return updateShared(src.Location, f.Self, export)
+	}
+	content, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(src.Location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("server", f.Self)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if src.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+src.Token)
+	}
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("publish %s: %s", src.Location, resp.Status)
+	}
+	return nil
+}
+
+// maxShared is the largest shared ban list fetched or accepted over
+// http, far more than tens of thousands of bans need.
+const maxShared = 16 << 20
+
+// sharedMutex serialises updates of shared files within this process.
+var sharedMutex = &sync.Mutex{}
+
+func readShared(filename string) (*Shared, error) {
+	shared := &Shared{Servers: make(map[string]*Export)}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return shared, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, shared); err != nil {
+		return nil, fmt.Errorf("shared ban list error (%s): %v", filename, err)
+	}
+	if shared.Servers == nil {
+		shared.Servers = make(map[string]*Export)
+	}
+	return shared, nil
+}
+
+// updateShared replaces the export of one server in a shared file.
+func updateShared(filename, server string, export *Export) error {
+	shared, err := readShared(filename)
+	if err != nil {
+		return err
+	}
+	shared.Servers[server] = export
+	content, err := json.MarshalIndent(shared, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%s.tmp", filename, server)
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// SharedHandler serves a shared ban list file over http: GET returns the
+// whole list, PUT ?server=name replaces the export of one server. Updates
+// need the token of that server in tokens as bearer token, so a server
+// cannot overwrite the bans of another one. Without tokens only clients on
+// the loopback interface may update. It is a minimal stand-in for a
+// central ban list service.
+func SharedHandler(filename string, tokens map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			sharedMutex.Lock()
+			shared, err := readShared(filename)
+			sharedMutex.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(shared)
+		case "PUT", "POST":
+			server := r.URL.Query().Get("server")
+			if server == "" {
+				http.Error(w, "missing server", http.StatusBadRequest)
+				return
+			}
+			if !mayPublish(r, server, tokens) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			var export Export
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShared)).Decode(&export); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sharedMutex.Lock()
+			err := updateShared(filename, server, &export)
+			sharedMutex.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// mayPublish reports whether r carries the token of server, or comes
+// from the loopback interface if there are no tokens.
+func mayPublish(r *http.Request, server string, tokens map[string]string) bool {
+	if len(tokens) > 0 {
+		token, ok := tokens[server]
+		if !ok || token == "" {
+			return false
+		}
+		auth := r.Header.Get("Authorization")
+		return subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
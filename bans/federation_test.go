@@ -0,0 +1,136 @@
+package bans
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFederationKeepsLocalUnbans(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := filepath.Join(dir, "shared.json")
+	f := &Federation{Self: "altis1", Store: store, Sources: []Source{{Name: "community", Location: shared, Import: true, Unbans: true}}}
+	const guid = "0123456789abcdef0123456789abcdef"
+	publish := func(bans ...Ban) {
+		if err := updateShared(shared, "altis2", &Export{Updated: time.Now(), Bans: bans}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() {
+		if _, err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	banned := func() bool {
+		_, ok := store.Find(guid, "", time.Now())
+		return ok
+	}
+
+	publish(Ban{GUID: guid, IP: "203.0.113.7", Reason: "cheating"})
+	sync()
+	list := store.List()
+	if len(list) != 1 || list[0].Origin != "altis2" {
+		t.Fatalf("imported %v", list)
+	}
+
+	// unbanned here, then a battleye sync pushes the removal
+	if _, err := store.Remove(list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ClearTombstone(guid, ""); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if banned() {
+		t.Fatal("local unban undone by the federation")
+	}
+
+	// the origin lifts the ban and issues it again later
+	publish()
+	sync()
+	publish(Ban{GUID: guid, Reason: "cheating again"})
+	sync()
+	if !banned() {
+		t.Fatal("new ban of the origin not imported")
+	}
+}
+
+func TestSharedHandlerNeedsToken(t *testing.T) {
+	handler := SharedHandler(filepath.Join(t.TempDir(), "shared.json"), map[string]string{"altis2": "secret", "altis3": "other"})
+	tests := []struct {
+		server string
+		auth   string
+		want   int
+	}{
+		{"altis2", "", http.StatusForbidden},
+		{"altis2", "Bearer wrong", http.StatusForbidden},
+		{"altis2", "Bearer secret", http.StatusNoContent},
+		// a token only publishes for its own server
+		{"altis3", "Bearer secret", http.StatusForbidden},
+		{"altis4", "Bearer secret", http.StatusForbidden},
+		{"altis3", "Bearer other", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("PUT", "/?server="+test.server, strings.NewReader(`{"Bans":[]}`))
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s with Authorization %q: got %d, want %d", test.server, test.auth, w.Code, test.want)
+		}
+	}
+
+	// without tokens only local clients may publish
+	handler = SharedHandler(filepath.Join(t.TempDir(), "shared.json"), nil)
+	for addr, want := range map[string]int{"127.0.0.1:4000": http.StatusNoContent, "203.0.113.7:4000": http.StatusForbidden} {
+		r := httptest.NewRequest("PUT", "/?server=altis2", strings.NewReader(`{"Bans":[]}`))
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("from %s: got %d, want %d", addr, w.Code, want)
+		}
+	}
+}
+
+func TestFederationUntrustedLists(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const guid = "0123456789abcdef0123456789abcdef"
+	lists := map[string]string{
+		"/null":  `{"Servers":{"x":null,"altis2":{"Bans":[{"Reason":"nobody"},{"GUID":"` + guid + `"}]}}}`,
+		"/large": `{"Servers":{"x":{"Bans":[{"Reason":"` + strings.Repeat("a", maxShared) + `"}]}}}`,
+	}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(lists[r.URL.Path]))
+	}))
+	defer peer.Close()
+
+	f := &Federation{Self: "altis1", Store: store, Sources: []Source{{Name: "peer", Location: peer.URL + "/null", Import: true, Unbans: true}}}
+	lines, err := f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Find(guid, "", time.Now()); !ok {
+		t.Error("ban next to a null export or an invalid ban not imported")
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0]+lines[1], "without GUID or IP (nobody)") {
+		t.Errorf("lines %q", lines)
+	}
+
+	f.Sources[0].Location = peer.URL + "/large"
+	if _, err := f.Sync(); err == nil {
+		t.Error("oversized list accepted")
+	}
+}
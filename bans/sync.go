@@ -0,0 +1,261 @@
+package bans
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a line of the reply to the BattlEye "bans" command.
+type Entry struct {
+	Index     int
+	GUID      string
+	IP        string
+	Minutes   int // minutes left, -1 once expired
+	Permanent bool
+	Reason    string
+}
+
+func (e *Entry) Expired() bool {
+	return !e.Permanent && e.Minutes < 0
+}
+
+func (e *Entry) Key() string {
+	if e.GUID != "" {
+		return e.GUID
+	}
+	return e.IP
+}
+
+var (
+	reParseBan = regexp.MustCompile(`^(\d+)\s+(\S+)\s+(perm|-|\d+)(?:\s+(.*))?$`)
+)
+
+// ParseList parses the reply of the "bans" command, which lists GUID bans
+// and IP bans in two sections.
+func ParseList(response string) []Entry {
+	var list []Entry
+	ip := false
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "GUID Bans:"):
+			ip = false
+			continue
+		case strings.HasPrefix(line, "IP Bans:"):
+			ip = true
+			continue
+		}
+		m := reParseBan.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		e := Entry{Reason: strings.TrimSpace(m[4])}
+		e.Index, _ = strconv.Atoi(m[1])
+		if ip {
+			e.IP = m[2]
+		} else {
+			e.GUID = strings.ToLower(m[2])
+		}
+		switch m[3] {
+		case "perm":
+			e.Permanent = true
+		case "-":
+			e.Minutes = -1
+		default:
+			e.Minutes, _ = strconv.Atoi(m[3])
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// Commander sends a command to BattlEye and returns its reply.
+// *udp.UDPClient implements it.
+type Commander interface {
+	Send(ctx context.Context, command string) (string, error)
+}
+
+// Report lists the divergences a sync found and what has been done
+// about them.
+type Report struct {
+	Imported []Ban   // in-game bans added to the local database
+	Pushed   []Ban   // local bans added to BattlEye
+	Removed  []Entry // expired or unbanned entries removed from BattlEye
+	Unbanned []Ban   // bans removed in game, removed locally as well
+	DryRun   bool
+}
+
+func (r *Report) Empty() bool {
+	return len(r.Imported) == 0 && len(r.Pushed) == 0 && len(r.Removed) == 0 && len(r.Unbanned) == 0
+}
+
+func (r *Report) Lines() []string {
+	prefix := ""
+	if r.DryRun {
+		prefix = "[SIMULATED] "
+	}
+	var lines []string
+	for _, b := range r.Imported {
+		lines = append(lines, fmt.Sprintf("%simported from battleye: %s", prefix, b.String()))
+	}
+	for _, b := range r.Pushed {
+		lines = append(lines, fmt.Sprintf("%spushed to battleye: %s", prefix, b.String()))
+	}
+	for _, e := range r.Removed {
+		lines = append(lines, fmt.Sprintf("%sremoved from battleye: #%d %s %s", prefix, e.Index, e.Key(), e.Reason))
+	}
+	for _, b := range r.Unbanned {
+		lines = append(lines, fmt.Sprintf("%sunbanned in game: %s", prefix, b.String()))
+	}
+	return lines
+}
+
+// Syncer reconciles the local database with the bans list of BattlEye.
+// Neither side wins blindly: bans only known to BattlEye are imported,
+// bans only known locally are pushed, and only expired or locally
+// removed bans are deleted from BattlEye. A local ban that has been on
+// the list before and is gone now was removed in game and is removed
+// locally as well.
+type Syncer struct {
+	Store  *Store
+	Client Commander
+	DryRun bool // report divergences without changing anything
+}
+
+func (s *Syncer) Sync(ctx context.Context) (*Report, error) {
+	response, err := s.Client.Send(ctx, "bans")
+	if err != nil {
+		return nil, err
+	}
+	remote := ParseList(response)
+	now := time.Now()
+	report := &Report{DryRun: s.DryRun}
+
+	tombstones := s.Store.Tombstones()
+	removed := func(e Entry) bool {
+		for _, t := range tombstones {
+			if (e.GUID != "" && t.GUID == e.GUID) || (e.IP != "" && t.IP == e.IP) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// battleye -> local
+	var seen []uint64
+	for _, e := range remote {
+		if e.Expired() || removed(e) {
+			report.Removed = append(report.Removed, e)
+			continue
+		}
+		if b, ok := s.Store.Find(e.GUID, e.IP, now); ok {
+			seen = append(seen, b.ID)
+			continue
+		}
+		b := Ban{GUID: e.GUID, IP: e.IP, Reason: e.Reason, Issuer: "battleye", Created: now, Listed: true}
+		if !e.Permanent {
+			b.Expires = now.Add(time.Duration(e.Minutes) * time.Minute)
+		}
+		if !s.DryRun {
+			if b, err = s.Store.Add(b); err != nil {
+				return report, err
+			}
+		}
+		report.Imported = append(report.Imported, b)
+	}
+	if !s.DryRun {
+		if err := s.Store.MarkListed(seen...); err != nil {
+			return report, err
+		}
+	}
+
+	// removals go first, the indices are those of the listing and
+	// battleye renumbers after each change; IP bans come after GUID bans,
+	// so every added GUID ban would shift them. From the highest index
+	// down the lower ones stay valid.
+	sort.Sort(sort.Reverse(byIndex(report.Removed)))
+	if !s.DryRun {
+		for _, e := range report.Removed {
+			if _, err := s.Client.Send(ctx, fmt.Sprintf("removeBan %d", e.Index)); err != nil {
+				return report, err
+			}
+			if err := s.Store.ClearTombstone(e.GUID, e.IP); err != nil {
+				return report, err
+			}
+		}
+		// removals battleye never knew about are done as well
+		for _, t := range tombstones {
+			if !onRemote(remote, Ban{GUID: t.GUID, IP: t.IP}) {
+				if err := s.Store.ClearTombstone(t.GUID, t.IP); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	// local -> battleye
+	for _, b := range s.Store.List() {
+		if b.Expired(now) || onRemote(remote, b) {
+			continue
+		}
+		if b.Listed {
+			// removed in game since the last sync
+			if !s.DryRun {
+				if _, err := s.Store.Remove(b.ID); err != nil {
+					return report, err
+				}
+			}
+			report.Unbanned = append(report.Unbanned, b)
+			continue
+		}
+		minutes := 0
+		if !b.Permanent() {
+			minutes = int((b.Remaining(now) + time.Minute - 1) / time.Minute)
+		}
+		target := b.GUID
+		if target == "" {
+			target = b.IP
+		}
+		if !s.DryRun {
+			if _, err := s.Client.Send(ctx, fmt.Sprintf("addBan %s %d %s", target, minutes, b.Reason)); err != nil {
+				return report, err
+			}
+			if err := s.Store.MarkListed(b.ID); err != nil {
+				return report, err
+			}
+		}
+		report.Pushed = append(report.Pushed, b)
+	}
+
+	if !s.DryRun {
+		if len(report.Removed) > 0 {
+			if _, err := s.Client.Send(ctx, "writeBans"); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+func onRemote(remote []Entry, b Ban) bool {
+	for _, e := range remote {
+		if e.Expired() {
+			continue
+		}
+		if (b.GUID != "" && e.GUID == b.GUID) || (b.GUID == "" && b.IP != "" && e.IP == b.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type byIndex []Entry
+
+func (l byIndex) Len() int           { return len(l) }
+func (l byIndex) Less(i, j int) bool { return l[i].Index < l[j].Index }
+func (l byIndex) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
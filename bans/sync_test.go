@@ -0,0 +1,251 @@
+package bans
+
+import (
+	"context"
+	"fmt"
+	"ghosthunter/emulator"
+	"ghosthunter/udp"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const bansReply = `GUID Bans:
+[#] [GUID] [Minutes left] [Reason]
+----------------------------------------
+0  0123456789ABCDEF0123456789ABCDEF perm Cheating
+1  fedcba9876543210fedcba9876543210 - Spam
+
+IP Bans:
+[#] [IP Address] [Minutes left] [Reason]
+----------------------------------------------
+2  203.0.113.7     1440 VPN
+3  198.51.100.1    perm`
+
+func TestParseList(t *testing.T) {
+	want := []Entry{
+		{Index: 0, GUID: "0123456789abcdef0123456789abcdef", Permanent: true, Reason: "Cheating"},
+		{Index: 1, GUID: "fedcba9876543210fedcba9876543210", Minutes: -1, Reason: "Spam"},
+		{Index: 2, IP: "203.0.113.7", Minutes: 1440, Reason: "VPN"},
+		{Index: 3, IP: "198.51.100.1", Permanent: true},
+	}
+	if got := ParseList(bansReply); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := ParseList("GUID Bans:\n\nIP Bans:\n"); len(got) != 0 {
+		t.Errorf("empty list parsed as %+v", got)
+	}
+}
+
+// banList keeps a bans list the way BattlEye does: GUID bans first, IP
+// bans after them, numbered together.
+type banList struct {
+	guids, ips []string // "<target> <minutes> <reason>"
+	mutex      sync.Mutex
+}
+
+func (l *banList) lists() ([]string, []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.guids...), append([]string(nil), l.ips...)
+}
+
+func (l *banList) serve(server *emulator.Server) {
+	server.Handle("bans", func(string) string {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		var b strings.Builder
+		b.WriteString("GUID Bans:\n[#] [GUID] [Minutes left] [Reason]\n----------------------------------------\n")
+		for i, line := range l.guids {
+			fmt.Fprintf(&b, "%d  %s\n", i, line)
+		}
+		b.WriteString("\nIP Bans:\n[#] [IP Address] [Minutes left] [Reason]\n----------------------------------------------\n")
+		for i, line := range l.ips {
+			fmt.Fprintf(&b, "%d  %s\n", len(l.guids)+i, line)
+		}
+		return b.String()
+	})
+	server.Handle("addBan", func(command string) string {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		fields := strings.SplitN(command, " ", 4)
+		minutes := "perm"
+		if fields[2] != "0" {
+			minutes = fields[2]
+		}
+		line := strings.TrimSpace(fields[1] + " " + minutes + " " + strings.Join(fields[3:], " "))
+		if net.ParseIP(fields[1]) != nil {
+			l.ips = append(l.ips, line)
+		} else {
+			l.guids = append(l.guids, line)
+		}
+		return ""
+	})
+	server.Handle("removeBan", func(command string) string {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		i, err := strconv.Atoi(strings.Fields(command)[1])
+		switch {
+		case err != nil || i < 0:
+			return "Invalid ban index"
+		case i < len(l.guids):
+			l.guids = append(l.guids[:i], l.guids[i+1:]...)
+		case i < len(l.guids)+len(l.ips):
+			i -= len(l.guids)
+			l.ips = append(l.ips[:i], l.ips[i+1:]...)
+		default:
+			return "Invalid ban index"
+		}
+		return ""
+	})
+	server.Reply("writeBans", "")
+}
+
+// connect runs a client against a fresh emulator until the test ends.
+func connect(t *testing.T) (*emulator.Server, *udp.UDPClient) {
+	t.Helper()
+	server, err := emulator.New(emulator.Config{Addr: "127.0.0.1:0", Password: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+
+	client := udp.NewUDPClient(&udp.Config{Server: server.Addr(), Rconpw: "test", ShutdownGrace: 1})
+	stopped := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(stopped)
+	}()
+	go func() {
+		for {
+			select {
+			case <-client.Err:
+			case <-client.CmdIn:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != udp.Online {
+		if time.Now().After(deadline) {
+			t.Fatalf("client not online: %v", client.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server, client
+}
+
+func TestSync(t *testing.T) {
+	const (
+		cheater  = "0123456789abcdef0123456789abcdef"
+		expired  = "fedcba9876543210fedcba9876543210"
+		local    = "00000000000000000000000000000001"
+		unbanned = "00000000000000000000000000000002"
+	)
+	server, client := connect(t)
+	list := &banList{
+		guids: []string{cheater + " perm Cheating", expired + " - Spam"},
+		ips:   []string{"203.0.113.7 perm VPN", "198.51.100.1 perm Lifted"},
+	}
+	list.serve(server)
+
+	store, err := Open(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lifted locally, has to go from battleye
+	lifted, err := store.Add(Ban{IP: "198.51.100.1", Reason: "Lifted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Remove(lifted.ID); err != nil {
+		t.Fatal(err)
+	}
+	// only known locally, has to be pushed
+	if _, err := store.Add(Ban{GUID: local, Reason: "Teamkilling"}); err != nil {
+		t.Fatal(err)
+	}
+	// was on battleye before and has been removed in game
+	gone, err := store.Add(Ban{GUID: unbanned, Reason: "Appeal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkListed(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := &Syncer{Store: store, Client: client}
+	report, err := syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) != 2 || len(report.Pushed) != 1 || len(report.Removed) != 2 || len(report.Unbanned) != 1 {
+		t.Errorf("report %v", report.Lines())
+	}
+
+	// the removals must not hit the wrong entries
+	wantGUIDs := []string{cheater + " perm Cheating", local + " perm Teamkilling"}
+	wantIPs := []string{"203.0.113.7 perm VPN"}
+	if guids, ips := list.lists(); !reflect.DeepEqual(guids, wantGUIDs) || !reflect.DeepEqual(ips, wantIPs) {
+		t.Errorf("battleye bans %q %q, want %q %q", guids, ips, wantGUIDs, wantIPs)
+	}
+	if _, ok := store.Find(unbanned, "", time.Now()); ok {
+		t.Error("ban removed in game is still active")
+	}
+	if len(store.Tombstones()) != 1 {
+		t.Errorf("tombstones %+v", store.Tombstones())
+	}
+
+	// in step now
+	report, err = syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Empty() {
+		t.Errorf("second sync %v", report.Lines())
+	}
+	if len(store.Tombstones()) != 0 {
+		t.Errorf("tombstones %+v", store.Tombstones())
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	server, client := connect(t)
+	list := &banList{guids: []string{"0123456789abcdef0123456789abcdef perm Cheating"}}
+	list.serve(server)
+	store, err := Open(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(Ban{IP: "203.0.113.7", Reason: "VPN"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := (&Syncer{Store: store, Client: client, DryRun: true}).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) != 1 || len(report.Pushed) != 1 {
+		t.Errorf("report %v", report.Lines())
+	}
+	if guids, ips := list.lists(); len(guids) != 1 || len(ips) != 0 || len(store.List()) != 1 {
+		t.Errorf("dry run changed something: %q %q %+v", guids, ips, store.List())
+	}
+	for _, c := range server.Commands() {
+		if c != "bans" {
+			t.Errorf("dry run sent %q", c)
+		}
+	}
+}
@@ -23,23 +23,31 @@ func NewBEHeader() *BEHeader {
 }
 
 func (n *BEHeader) Unmarshal(rawBytes []byte) error {
+	if err := n.unmarshalAnyType(rawBytes); err != nil {
+		return err
+	}
+	if !(n.PacketType == 0x00 || n.PacketType == 0x01 || n.PacketType == 0x02) {
+		return fmt.Errorf("invalid packet header: packet type (0x%x)", n.PacketType)
+	}
+	return nil
+}
+
+// unmarshalAnyType decodes a header without checking the packet type.
+func (n *BEHeader) unmarshalAnyType(rawBytes []byte) error {
 	length := len(rawBytes)
 	if length < 8 {
 		return fmt.Errorf("invalid packet header: packet length too small (%d)", length)
 	}
-	n.MagicBytes = rawBytes[:2]
+	n.MagicBytes = append([]byte(nil), rawBytes[:2]...)
 	if !bytes.Equal(n.MagicBytes, []byte("BE")) {
 		return fmt.Errorf("invalid packet header: magic bytes (%s)", n.MagicBytes)
 	}
-	n.Crc = rawBytes[2:6]
+	n.Crc = append([]byte(nil), rawBytes[2:6]...)
 	n.Spacer = rawBytes[6:7][0]
 	if n.Spacer != 0xFF {
 		return fmt.Errorf("invalid packet header: spacer (0x%x)", n.Spacer)
 	}
 	n.PacketType = rawBytes[7:8][0]
-	if !(n.PacketType == 0x00 || n.PacketType == 0x01 || n.PacketType == 0x02) {
-		return fmt.Errorf("invalid packet header: packet type (0x%x)", n.PacketType)
-	}
 	return nil
 }
 
@@ -60,6 +68,25 @@ func (b *BEHeader) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// unmarshalPacket decodes the header of a packet of the given type that
+// is at least min bytes long and checks its CRC.
+func (n *BEHeader) unmarshalPacket(rawBytes []byte, packetType byte, min int) error {
+	if len(rawBytes) < min {
+		return fmt.Errorf("invalid packet: packet length too small (%d)", len(rawBytes))
+	}
+	if err := n.Unmarshal(rawBytes[:8]); err != nil {
+		return err
+	}
+	if n.PacketType != packetType {
+		return fmt.Errorf("invalid packet: packet type (0x%x)", n.PacketType)
+	}
+	crc, _ := CRC32(rawBytes[6:])
+	if !bytes.Equal(crc, n.Crc) {
+		return fmt.Errorf("invalid packet: crc mismatch (%x != %x)", n.Crc, crc)
+	}
+	return nil
+}
+
 type BEClientLogin struct {
 	Header   BEHeader
 	Password string
@@ -74,7 +101,7 @@ func NewBEClientLogin() *BEClientLogin {
 }
 
 func (b *BEClientLogin) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:8])
+	err := b.Header.unmarshalPacket(rawBytes, 0x00, 8)
 	if err != nil {
 		return err
 	}
@@ -85,7 +112,7 @@ func (b *BEClientLogin) Unmarshal(rawBytes []byte) error {
 func (b *BEClientLogin) Marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	length := 0
-	hash, err := getHash([]byte{b.Header.Spacer, b.Header.PacketType}, []byte(b.Password))
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType}, []byte(b.Password))
 	if err != nil {
 		return nil, err
 	}
@@ -118,10 +145,10 @@ func NewBEServerLogin() *BEServerLogin {
 }
 
 func (b *BEServerLogin) Unmarshal(rawBytes []byte) error {
-	if len(rawBytes) < 9 {
+	if len(rawBytes) != 9 {
 		return fmt.Errorf("invalid packet response: no login response")
 	}
-	err := b.Header.Unmarshal(rawBytes[:8])
+	err := b.Header.unmarshalPacket(rawBytes, 0x00, 9)
 	if err != nil {
 		return err
 	}
@@ -132,7 +159,7 @@ func (b *BEServerLogin) Unmarshal(rawBytes []byte) error {
 func (b *BEServerLogin) Marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	length := 0
-	hash, err := getHash([]byte{b.Header.Spacer, b.Header.PacketType}, []byte{b.LoginResponse})
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType}, []byte{b.LoginResponse})
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +195,7 @@ func NewBEClientCommand() *BEClientCommand {
 }
 
 func (b *BEClientCommand) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:8])
+	err := b.Header.unmarshalPacket(rawBytes, 0x01, 9)
 	if err != nil {
 		return err
 	}
@@ -180,7 +207,7 @@ func (b *BEClientCommand) Unmarshal(rawBytes []byte) error {
 func (b *BEClientCommand) Marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	length := 0
-	hash, err := getHash([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence}, []byte(b.Command))
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence}, []byte(b.Command))
 	if err != nil {
 		return nil, err
 	}
@@ -225,18 +252,26 @@ func NewBEServerCommand() *BEServerCommand {
 }
 
 func (b *BEServerCommand) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:8])
+	err := b.Header.unmarshalPacket(rawBytes, 0x01, 9)
 	if err != nil {
 		return err
 	}
 	b.Sequence = rawBytes[8:9][0]
+	b.OptionalHeader = nil
+	b.Response = ""
 	if len(rawBytes) >= 10 {
 		if rawBytes[9:10][0] == 0x00 {
 			// optional header
+			if len(rawBytes) < 12 {
+				return fmt.Errorf("invalid packet: truncated multipart header (%d)", len(rawBytes))
+			}
 			b.OptionalHeader = &BEOptionalHeader{}
 			b.OptionalHeader.MagicByte = 0x00
 			b.OptionalHeader.NumberOfPackets = rawBytes[10:11][0]
 			b.OptionalHeader.Index = rawBytes[11:12][0]
+			if b.OptionalHeader.Index >= b.OptionalHeader.NumberOfPackets {
+				return fmt.Errorf("invalid packet: multipart index out of range (%d/%d)", b.OptionalHeader.Index, b.OptionalHeader.NumberOfPackets)
+			}
 			b.Response = string(rawBytes[12:])
 		} else {
 			b.Response = string(rawBytes[9:])
@@ -245,6 +280,36 @@ func (b *BEServerCommand) Unmarshal(rawBytes []byte) error {
 	return nil
 }
 
+func (b *BEServerCommand) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	var optional []byte
+	if b.OptionalHeader != nil {
+		if b.OptionalHeader.Index >= b.OptionalHeader.NumberOfPackets {
+			return nil, fmt.Errorf("invalid packet: multipart index out of range (%d/%d)", b.OptionalHeader.Index, b.OptionalHeader.NumberOfPackets)
+		}
+		optional = []byte{0x00, b.OptionalHeader.NumberOfPackets, b.OptionalHeader.Index}
+	} else if len(b.Response) > 0 && b.Response[0] == 0x00 {
+		return nil, fmt.Errorf("invalid packet: response starts with the multipart marker")
+	}
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence}, optional, []byte(b.Response))
+	if err != nil {
+		return nil, err
+	}
+	b.Header.Crc = hash
+	wb, err := b.Header.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(wb)
+	buf.WriteByte(b.Sequence)
+	buf.Write(optional)
+	buf.WriteString(b.Response)
+	if buf.Len() != (9 + len(optional) + len(b.Response)) {
+		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
 type BEClientMessage struct {
 	Header   BEHeader
 	Sequence byte
@@ -259,7 +324,10 @@ func NewBEClientMessage() *BEClientMessage {
 }
 
 func (b *BEClientMessage) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:8])
+	if len(rawBytes) != 9 {
+		return fmt.Errorf("invalid packet: packet length mismatch (%d)", len(rawBytes))
+	}
+	err := b.Header.unmarshalPacket(rawBytes, 0x02, 9)
 	if err != nil {
 		return err
 	}
@@ -270,7 +338,7 @@ func (b *BEClientMessage) Unmarshal(rawBytes []byte) error {
 func (b *BEClientMessage) Marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	length := 0
-	hash, err := getHash([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence})
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence})
 	if err != nil {
 		return nil, err
 	}
@@ -305,7 +373,7 @@ func NewBEServerMessage() *BEServerMessage {
 }
 
 func (b *BEServerMessage) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:8])
+	err := b.Header.unmarshalPacket(rawBytes, 0x02, 9)
 	if err != nil {
 		return err
 	}
@@ -317,7 +385,7 @@ func (b *BEServerMessage) Unmarshal(rawBytes []byte) error {
 func (b *BEServerMessage) Marshal() ([]byte, error) {
 	var buf bytes.Buffer
 	length := 0
-	hash, err := getHash([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence}, []byte(b.Message))
+	hash, err := CRC32([]byte{b.Header.Spacer, b.Header.PacketType, b.Sequence}, []byte(b.Message))
 	if err != nil {
 		return nil, err
 	}
@@ -338,15 +406,8 @@ func (b *BEServerMessage) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func getHash(bytes ...[]byte) ([]byte, error) {
-	hash := crc32.NewIEEE()
-	for _, x := range bytes {
-		hash.Write(x)
-	}
-	raw := hash.Sum32()
-	return []byte{byte(raw & 0x000000ff), byte(raw & 0x0000ff00 >> 8), byte(raw & 0x00ff0000 >> 16), byte(raw & 0xff000000 >> 24)}, nil
-}
-
+// CRC32 returns the little endian checksum BattlEye puts into the header,
+// computed over everything after it starting with the spacer.
 func CRC32(bytes ...[]byte) ([]byte, error) {
 	hash := crc32.NewIEEE()
 	for _, x := range bytes {
@@ -354,5 +415,4 @@ func CRC32(bytes ...[]byte) ([]byte, error) {
 	}
 	raw := hash.Sum32()
 	return []byte{byte(raw & 0x000000ff), byte(raw & 0x0000ff00 >> 8), byte(raw & 0x00ff0000 >> 16), byte(raw & 0xff000000 >> 24)}, nil
-
 }
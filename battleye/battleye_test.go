@@ -0,0 +1,160 @@
+package battleye
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTrip marshals p, decodes the result as sent from d and compares it
+// with p.
+func roundTrip(t *testing.T, d Direction, p BEPacket) {
+	raw, err := p.Marshal()
+	if err != nil {
+		return
+	}
+	got, err := DecodeFrom(d, raw)
+	if err != nil {
+		t.Fatalf("DecodeFrom(%s, %x): %v", d, raw, err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("round trip of %x\n got %#v\nwant %#v", raw, got, p)
+	}
+}
+
+func FuzzRoundTripClientLogin(f *testing.F) {
+	f.Add("secret")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, password string) {
+		p := NewBEClientLogin()
+		p.Password = password
+		roundTrip(t, FromClient, p)
+	})
+}
+
+func FuzzRoundTripServerLogin(f *testing.F) {
+	f.Add(byte(0x01))
+	f.Add(byte(0x00))
+	f.Fuzz(func(t *testing.T, response byte) {
+		p := NewBEServerLogin()
+		p.LoginResponse = response
+		roundTrip(t, FromServer, p)
+	})
+}
+
+func FuzzRoundTripClientCommand(f *testing.F) {
+	f.Add(byte(0), "players")
+	f.Add(byte(255), "")
+	f.Fuzz(func(t *testing.T, seq byte, command string) {
+		p := NewBEClientCommand()
+		p.Sequence = seq
+		p.Command = command
+		roundTrip(t, FromClient, p)
+	})
+}
+
+func FuzzRoundTripServerCommand(f *testing.F) {
+	f.Add(byte(0), false, byte(0), byte(0), "Players on server:")
+	f.Add(byte(7), true, byte(3), byte(2), "part")
+	f.Add(byte(255), false, byte(0), byte(0), "")
+	f.Fuzz(func(t *testing.T, seq byte, multipart bool, count byte, index byte, response string) {
+		p := NewBEServerCommand()
+		p.Sequence = seq
+		p.Response = response
+		if multipart {
+			p.OptionalHeader = &BEOptionalHeader{MagicByte: 0x00, NumberOfPackets: count, Index: index}
+		}
+		roundTrip(t, FromServer, p)
+	})
+}
+
+func FuzzRoundTripClientMessage(f *testing.F) {
+	f.Add(byte(0))
+	f.Add(byte(255))
+	f.Fuzz(func(t *testing.T, seq byte) {
+		p := NewBEClientMessage()
+		p.Sequence = seq
+		roundTrip(t, FromClient, p)
+	})
+}
+
+func FuzzRoundTripServerMessage(f *testing.F) {
+	f.Add(byte(0), "Player #3 John Doe disconnected")
+	f.Add(byte(255), "")
+	f.Fuzz(func(t *testing.T, seq byte, message string) {
+		p := NewBEServerMessage()
+		p.Sequence = seq
+		p.Message = message
+		roundTrip(t, FromServer, p)
+	})
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	command := NewBEServerCommand()
+	command.Sequence = 4
+	command.OptionalHeader = &BEOptionalHeader{MagicByte: 0x00, NumberOfPackets: 2, Index: 1}
+	command.Response = "Players on server:"
+	login := NewBEClientLogin()
+	login.Password = "secret"
+	clientCommand := NewBEClientCommand()
+	clientCommand.Sequence = 4
+	clientCommand.Command = "players"
+	message := NewBEServerMessage()
+	message.Sequence = 9
+	message.Message = "RCon admin #0 (127.0.0.1:52814) logged in"
+	serverLogin := NewBEServerLogin()
+	serverLogin.LoginResponse = 0x01
+	ack := NewBEClientMessage()
+	ack.Sequence = 9
+
+	tests := []struct {
+		d Direction
+		p BEPacket
+	}{
+		{FromClient, login},
+		{FromServer, serverLogin},
+		{FromClient, clientCommand},
+		{FromServer, command},
+		{FromClient, ack},
+		{FromServer, message},
+	}
+	for _, test := range tests {
+		raw, err := test.p.Marshal()
+		if err != nil {
+			t.Fatalf("%T: %v", test.p, err)
+		}
+		for n := 0; n < len(raw); n++ {
+			if p, err := DecodeFrom(test.d, raw[:n]); err == nil {
+				t.Errorf("%T truncated to %d bytes: decoded as %#v", test.p, n, p)
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	message := NewBEServerMessage()
+	message.Message = "hello"
+	raw, err := message.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownType := append([]byte(nil), raw...)
+	unknownType[7] = 0x05
+
+	tests := []struct {
+		d    Direction
+		raw  []byte
+		want string
+	}{
+		{Direction(7), raw, "unknown direction (Direction(7))"},
+		// the direction is checked first
+		{Direction(7), unknownType, "unknown direction (Direction(7))"},
+		{FromServer, unknownType, "unknown packet type (0x5) from server"},
+		{FromClient, unknownType, "unknown packet type (0x5) from client"},
+	}
+	for _, test := range tests {
+		if _, err := DecodeFrom(test.d, test.raw); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("DecodeFrom(%s, %x): got %v, want %q", test.d, test.raw, err, test.want)
+		}
+	}
+}
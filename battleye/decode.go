@@ -0,0 +1,69 @@
+package battleye
+
+import (
+	"fmt"
+)
+
+// Direction tells Decode which side has sent a packet. Both sides use the
+// same packet types with different layouts.
+type Direction byte
+
+const (
+	FromServer Direction = iota // packets a client receives
+	FromClient                  // packets a server receives
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromServer:
+		return "server"
+	case FromClient:
+		return "client"
+	}
+	return fmt.Sprintf("Direction(%d)", byte(d))
+}
+
+// Decode checks magic bytes, CRC and type of a packet sent by the server
+// and returns it as *BEServerLogin, *BEServerCommand or *BEServerMessage.
+func Decode(rawBytes []byte) (BEPacket, error) {
+	return DecodeFrom(FromServer, rawBytes)
+}
+
+// DecodeFrom decodes a packet sent from d. Packets sent by a client are
+// returned as *BEClientLogin, *BEClientCommand or *BEClientMessage. An
+// unknown direction and an unknown packet type are reported separately.
+func DecodeFrom(d Direction, rawBytes []byte) (BEPacket, error) {
+	var login, command, message func() BEPacket
+	switch d {
+	case FromServer:
+		login = func() BEPacket { return NewBEServerLogin() }
+		command = func() BEPacket { return NewBEServerCommand() }
+		message = func() BEPacket { return NewBEServerMessage() }
+	case FromClient:
+		login = func() BEPacket { return NewBEClientLogin() }
+		command = func() BEPacket { return NewBEClientCommand() }
+		message = func() BEPacket { return NewBEClientMessage() }
+	default:
+		return nil, fmt.Errorf("invalid packet: unknown direction (%s)", d)
+	}
+
+	var header BEHeader
+	if err := header.unmarshalAnyType(rawBytes); err != nil {
+		return nil, err
+	}
+	var packet BEPacket
+	switch header.PacketType {
+	case 0x00:
+		packet = login()
+	case 0x01:
+		packet = command()
+	case 0x02:
+		packet = message()
+	default:
+		return nil, fmt.Errorf("invalid packet: unknown packet type (0x%x) from %s", header.PacketType, d)
+	}
+	if err := packet.Unmarshal(rawBytes); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
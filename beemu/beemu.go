@@ -0,0 +1,132 @@
+// beemu runs the BattlEye RCon emulator for manual testing. Lines typed
+// on stdin are pushed as server messages, except for:
+//
+//	silence <seconds>
+//	faults <loss> <duplicate> <reorder>
+//	clients
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"ghosthunter/emulator"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const players = `Players on server:
+[#] [IP Address]:[Port] [Ping] [GUID] [Name]
+--------------------------------------------------
+0   127.0.0.1:2304        0    0123456789abcdef0123456789abcdef(OK) Tester
+(1 players in total)`
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:2302", "listen address")
+	password := flag.String("password", "test", "rcon password")
+	payload := flag.Int("payload", emulator.DefaultMaxPayload, "bytes per reply packet")
+	loss := flag.Float64("loss", 0, "packet loss probability")
+	duplicate := flag.Float64("dup", 0, "packet duplication probability")
+	reorder := flag.Float64("reorder", 0, "packet reordering probability")
+	delay := flag.Duration("delay", 200*time.Millisecond, "delay of reordered packets")
+	script := flag.String("script", "", "file with \"<seconds> <message>\" lines to push")
+	replies := flag.String("replies", "", "json file mapping commands to responses")
+	flag.Parse()
+
+	server, err := emulator.New(emulator.Config{
+		Addr:       *listen,
+		Password:   *password,
+		MaxPayload: *payload,
+		Faults:     emulator.Faults{Loss: *loss, Duplicate: *duplicate, Reorder: *reorder, Delay: *delay},
+		Logger:     log.New(os.Stderr, "", log.LstdFlags),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server.Reply("players", players)
+	if *replies != "" {
+		raw, err := ioutil.ReadFile(*replies)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		var responses map[string]string
+		if err := json.Unmarshal(raw, &responses); err != nil {
+			log.Fatalf("%s: %v", *replies, err)
+		}
+		for command, response := range responses {
+			server.Reply(command, response)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		steps, err := emulator.ParseScript(f)
+		f.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go server.Play(ctx, steps)
+	}
+	go console(server)
+
+	log.Printf("listening on %s", server.Addr())
+	if err := server.Run(ctx); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func console(server *emulator.Server) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case line == "":
+		case fields[0] == "silence" && len(fields) == 2:
+			seconds, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			server.Silence(time.Duration(seconds * float64(time.Second)))
+		case fields[0] == "faults" && len(fields) == 4:
+			// the delay is only set on the command line
+			f := server.Faults()
+			var errs [3]error
+			f.Loss, errs[0] = strconv.ParseFloat(fields[1], 64)
+			f.Duplicate, errs[1] = strconv.ParseFloat(fields[2], 64)
+			f.Reorder, errs[2] = strconv.ParseFloat(fields[3], 64)
+			if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+				log.Println("usage: faults <loss> <duplicate> <reorder>")
+				continue
+			}
+			server.SetFaults(f)
+		case line == "clients":
+			log.Printf("%d clients, %d unacknowledged messages", server.Clients(), server.Unacked())
+		default:
+			server.Push(line)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package chatfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"ghosthunter/events"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_REASON = "Chat Filter #{rule}"
+)
+
+// Action is what happens when a rule matches. The numeric values are the
+// reactions of the legacy txt format.
+type Action byte
+
+const (
+	None         Action = iota
+	Log                 // chat log
+	Print               // console
+	LogPrint            // chat log and console
+	Simulate            // console and chat log, marked as simulated kick
+	Kick                // kick, kick log
+	KickPrint           // kick, console
+	KickLogPrint        // kick, kick log and console
+	Ban                 // ban, ban log and console
+
+	unset Action = 0xff // json rules without an action
+)
+
+var actionNames = map[string]Action{
+	"none":         None,
+	"log":          Log,
+	"print":        Print,
+	"logprint":     LogPrint,
+	"simulate":     Simulate,
+	"kick":         Kick,
+	"kickprint":    KickPrint,
+	"kicklogprint": KickLogPrint,
+	"ban":          Ban,
+}
+
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		v, ok := actionNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown action (%s)", name)
+		}
+		*a = v
+		return nil
+	}
+	var n byte
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid action (%s)", data)
+	}
+	if Action(n) > Ban {
+		return fmt.Errorf("unknown action (%d)", n)
+	}
+	*a = Action(n)
+	return nil
+}
+
+func (a Action) String() string {
+	for k, v := range actionNames {
+		if v == a {
+			return k
+		}
+	}
+	return strconv.Itoa(int(a))
+}
+
+// Rule is a single chat filter entry. Legacy rules match the whole server
+// line, rules from the json format only match the message text.
+type Rule struct {
+	ID            string
+	Description   string
+	Regex         string
+	CaseSensitive bool
+	Channels      []events.Channel // empty means all channels
+	Action        Action
+	Reason        string   // kick/ban reason template
+	BanMinutes    int      // 0 bans permanently
+	Exempt        []string // GUIDs
+	re            *regexp.Regexp
+	matchLine     bool
+}
+
+var channels = []events.Channel{events.Global, events.Side, events.Vehicle, events.Direct, events.Group, events.Command}
+
+// validate rejects json rules that would silently never match or do
+// nothing useful.
+func (r *Rule) validate() error {
+	if strings.TrimSpace(r.Regex) == "" {
+		return fmt.Errorf("rule %s: empty regex", r.ID)
+	}
+	if r.Action == unset {
+		return fmt.Errorf("rule %s: missing action", r.ID)
+	}
+Channels:
+	for _, c := range r.Channels {
+		for _, known := range channels {
+			if strings.EqualFold(string(c), string(known)) {
+				continue Channels
+			}
+		}
+		return fmt.Errorf("rule %s: unknown channel (%s)", r.ID, c)
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	expr := r.Regex
+	if !r.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.ID, err)
+	}
+	r.re = re
+	return nil
+}
+
+// Matches reports whether the rule applies to a message sent by the
+// player with the given GUID.
+func (r *Rule) Matches(msg events.ChatMessage, guid string) bool {
+	if len(r.Channels) > 0 {
+		found := false
+		for _, c := range r.Channels {
+			if strings.EqualFold(string(c), string(msg.Channel)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if guid != "" {
+		for _, g := range r.Exempt {
+			if strings.EqualFold(g, guid) {
+				return false
+			}
+		}
+	}
+	if r.matchLine {
+		return r.re.MatchString(msg.Raw)
+	}
+	return r.re.MatchString(msg.Text)
+}
+
+// FormatReason fills the reason template of the rule. Known placeholders
+// are {rule}, {id}, {name} and {guid}.
+func (r *Rule) FormatReason(id int, name, guid string) string {
+	reason := r.Reason
+	if reason == "" {
+		reason = DEFAULT_REASON
+	}
+	return strings.NewReplacer(
+		"{rule}", r.ID,
+		"{id}", strconv.Itoa(id),
+		"{name}", name,
+		"{guid}", guid,
+	).Replace(reason)
+}
+
+type Filter struct {
+	Filename string
+	Rules    []*Rule
+}
+
+// Options change how legacy txt filters are read, the json format is not
+// affected.
+type Options struct {
+	LegacyReasons bool // accept a reason after the regex, older versions skipped such lines
+}
+
+// Load reads a filter file. Files ending in .json use the structured
+// format, anything else is read as legacy "reaction regex [reason]" lines.
+func Load(filename string, o Options) (*Filter, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// strip utf-8 byte order mark
+	content = []byte(strings.TrimPrefix(string(content), "\ufeff"))
+
+	var rules []*Rule
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		rules, err = parseJSON(content)
+	} else {
+		rules, err = parseLegacy(filename, content, o)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chat filter error (%s): %v", filename, err)
+	}
+	return &Filter{Filename: filename, Rules: rules}, nil
+}
+
+func parseJSON(content []byte) ([]*Rule, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0, len(raw))
+	ids := make(map[string]bool, len(raw))
+	for i, v := range raw {
+		r := &Rule{Action: unset}
+		err := json.Unmarshal(v, r)
+		if r.ID == "" {
+			r.ID = strconv.Itoa(i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.ID, err)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("duplicate rule id (%s)", r.ID)
+		}
+		ids[r.ID] = true
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseLegacy reads "reaction regex [reason]" lines. Lines with a reason
+// are skipped unless o.LegacyReasons is set, as older versions did, and
+// logged so they do not go unnoticed. Reactions above Ban do nothing.
+func parseLegacy(filename string, content []byte, o Options) ([]*Rule, error) {
+	var rules []*Rule
+	for i, v := range strings.Split(string(content), "\n") {
+		// reaction regex [reason template]
+		raw := strings.Fields(v)
+		if len(raw) < 2 {
+			continue
+		}
+		if len(raw) > 2 && !o.LegacyReasons {
+			log.Printf("chat filter %s: line %d skipped, reasons are not enabled (%s)", filename, i+1, strings.TrimSpace(v))
+			continue
+		}
+		r := &Rule{
+			ID:            strconv.Itoa(i),
+			Regex:         raw[1],
+			CaseSensitive: true,
+			Reason:        strings.Join(raw[2:], " "),
+			matchLine:     true,
+		}
+		v1, err := strconv.ParseUint(raw[0], 0, 8)
+		switch {
+		case err != nil:
+			r.Action = Log
+		case Action(v1) > Ban:
+			r.Action = None
+		default:
+			r.Action = Action(v1)
+		}
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,144 @@
+package chatfilter
+
+import (
+	"ghosthunter/events"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const guid = "0123456789abcdef0123456789abcdef"
+
+// load writes content to a file with the given name and loads it.
+func load(t *testing.T, name, content string, o Options) (*Filter, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(filename, o)
+}
+
+func chat(channel events.Channel, text string) events.ChatMessage {
+	raw := "(" + string(channel) + ") John Doe: " + text
+	return events.Parse(raw).(events.ChatMessage)
+}
+
+func TestJSON(t *testing.T) {
+	f, err := load(t, "chat.json", `[
+		{"ID": "advert", "Regex": "www\\.", "Channels": ["global", "Side"], "Action": "kick", "Reason": "Advertising #{rule} {name} {guid} {id}", "Exempt": ["`+strings.ToUpper(guid)+`"]},
+		{"Regex": "Nano", "CaseSensitive": true, "Action": 1},
+		{"ID": "hello", "Regex": "hello", "Action": "Ban", "BanMinutes": 60}
+	]`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Rules) != 3 {
+		t.Fatalf("got %d rules", len(f.Rules))
+	}
+	advert, nano, hello := f.Rules[0], f.Rules[1], f.Rules[2]
+	if nano.ID != "1" || nano.Action != Log || advert.Action != Kick || hello.Action != Ban || hello.BanMinutes != 60 {
+		t.Errorf("rules %+v %+v %+v", advert, nano, hello)
+	}
+
+	tests := []struct {
+		rule *Rule
+		msg  events.ChatMessage
+		guid string
+		want bool
+	}{
+		{advert, chat(events.Global, "visit WWW.example.com"), "", true},
+		{advert, chat(events.Side, "visit www.example.com"), "", true},
+		{advert, chat(events.Direct, "visit www.example.com"), "", false},
+		{advert, chat(events.Global, "visit www.example.com"), guid, false},
+		{advert, chat(events.Global, "visit www.example.com"), "fedcba9876543210fedcba9876543210", true},
+		{nano, chat(events.Group, "Nano is here"), "", true},
+		{nano, chat(events.Group, "nano is here"), "", false},
+		// json rules only see the text, not the channel or sender
+		{hello, chat(events.Vehicle, "hello"), "", true},
+		{nano, events.Parse("(Global) Nano: hi").(events.ChatMessage), "", false},
+	}
+	for _, test := range tests {
+		if got := test.rule.Matches(test.msg, test.guid); got != test.want {
+			t.Errorf("rule %s on %q from %q: got %v", test.rule.ID, test.msg.Raw, test.guid, got)
+		}
+	}
+
+	if got := advert.FormatReason(3, "John Doe", guid); got != "Advertising #advert John Doe "+guid+" 3" {
+		t.Errorf("reason %q", got)
+	}
+	if got := nano.FormatReason(3, "John Doe", guid); got != "Chat Filter #1" {
+		t.Errorf("default reason %q", got)
+	}
+}
+
+func TestJSONInvalid(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`[{"ID": "a", "Action": "kick"}]`, "rule a: empty regex"},
+		{`[{"ID": "a", "Regex": " ", "Action": "kick"}]`, "rule a: empty regex"},
+		{`[{"ID": "a", "Regex": "x"}]`, "rule a: missing action"},
+		{`[{"ID": "a", "Regex": "x", "Action": "kick", "Channels": ["Gloabl"]}]`, "rule a: unknown channel (Gloabl)"},
+		{`[{"ID": "a", "Regex": "x", "Action": "shout"}]`, "rule a: unknown action (shout)"},
+		{`[{"ID": "a", "Regex": "(", "Action": "kick"}]`, "rule a: error parsing regexp"},
+		{`[{"ID": "a", "Regex": "x", "Action": 1}, {"ID": "a", "Regex": "y", "Action": 1}]`, "duplicate rule id (a)"},
+	}
+	for _, test := range tests {
+		_, err := load(t, "chat.json", test.content, Options{})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.content, err, test.want)
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	const content = "\ufeff1 nano\n" +
+		"5 (?:www\\.\\w+) Advertising (#{rule})\n" +
+		"x hello\n" +
+		"9 ignored\n" +
+		"\n" +
+		"lonely\n"
+
+	f, err := load(t, "chat.txt", content, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the line with a reason is skipped as older versions did
+	if len(f.Rules) != 3 {
+		t.Fatalf("got %d rules: %+v", len(f.Rules), f.Rules)
+	}
+	if f.Rules[0].Action != Log || f.Rules[1].Action != Log || f.Rules[2].Action != None {
+		t.Errorf("actions %v %v %v", f.Rules[0].Action, f.Rules[1].Action, f.Rules[2].Action)
+	}
+
+	f, err = load(t, "chat.txt", content, Options{LegacyReasons: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Rules) != 4 {
+		t.Fatalf("got %d rules: %+v", len(f.Rules), f.Rules)
+	}
+	advert := f.Rules[1]
+	if advert.ID != "1" || advert.Action != Kick || advert.FormatReason(3, "John Doe", guid) != "Advertising (#1)" {
+		t.Errorf("rule %+v", advert)
+	}
+
+	// legacy rules are case sensitive and match the whole line
+	nano := f.Rules[0]
+	for line, want := range map[string]bool{
+		"(Global) nano: hi":   true,
+		"(Global) John: hi":   false,
+		"(Global) John: NANO": false,
+	} {
+		if got := nano.Matches(events.Parse(line).(events.ChatMessage), ""); got != want {
+			t.Errorf("%q: got %v", line, got)
+		}
+	}
+
+	if _, err := load(t, "chat.txt", "1 (", Options{}); err == nil {
+		t.Error("invalid regex loaded")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"ghosthunter/api"
+	"ghosthunter/bans"
+	"ghosthunter/udp"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServerConfig is the configuration of one supervised server.
+type ServerConfig struct {
+	udp.Config
+	Name        string // server name, defaults to the address
+	LogDir      string // directory of the log files
+	PlayerPoll  int    // seconds, 0 disables polling
+	DryRun      bool   // only simulate filter kicks and bans
+	ChatFilter  string // path of the chat filter (.json or legacy .txt)
+	BanDatabase string // path of the local ban database
+	BanSync     int    // seconds between syncs with the battleye bans list, 0 disables
+	Capture     bool   // record every packet to capture.log in LogDir
+	CapturePcap bool   // also write capture.pcap for wireshark
+
+	ChatFilterReasons bool // legacy .txt filter lines may carry a reason after the regex; off skips them as older versions did
+
+	BanSources    []bans.Source // shared ban lists
+	BanFederation int           // seconds between shared ban list syncs, 0 disables
+
+	PlayerAPI        string      // player api url, %s is replaced by the GUID; empty disables lookups
+	PlayerAPIOptions api.Options // timeouts, retries, caching and circuit breaker
+	Enforcement      Enforcement // what happens to players the player api has flagged
+
+	GeoIP    string             // path of a MaxMind country database (mmdb), empty disables country lookups
+	Country  CountryRestriction // which countries players may join from
+	GeoIPASN string             // path of a MaxMind ASN database (mmdb), needed for AS numbers in blocklists
+	VPN      VPNCheck           // players joining from VPNs, proxies and hosting networks
+}
+
+// CountryRestriction keeps players from other countries out. Countries are
+// ISO 3166 codes like "DE". An empty Allow list allows every country that
+// is not denied.
+type CountryRestriction struct {
+	Action       string   // "log" or "kick", empty disables the restriction
+	Allow        []string // countries players may join from
+	Deny         []string // countries players may not join from
+	AllowUnknown bool     // let players in whose country cannot be resolved
+	Reason       string   // kick reason, {country}, {id}, {name} and {guid} are replaced
+	Whitelist    []string // GUIDs exempt from the restriction
+}
+
+// VPNCheck flags players joining from networks listed in local blocklist
+// files. Each line of a blocklist is a CIDR range, an address or an AS
+// number like "AS16509".
+type VPNCheck struct {
+	Action     string   // "log", "warn" or "kick", empty disables the check
+	Blocklists []string // datacenter, hosting and VPN ranges
+	Reason     string   // kick reason, {asn}, {org}, {id}, {name} and {guid} are replaced
+	Exempt     []string // GUIDs exempt from the check
+}
+
+// Enforcement decides what happens to players the player api has flagged.
+// Actions are "log", "kick", "ban" or empty to ignore the flag.
+type Enforcement struct {
+	CentralBan       string
+	CentralBanReason string
+	VACBan           string // unless the player api sets ByPassVAC
+	VACBanReason     string
+	BanMinutes       int // 0 bans permanently
+
+	// while the player api cannot be reached; empty lets players in
+	// (fail open), "log" lets them in and logs it, "kick" keeps them out
+	// (fail closed)
+	Unavailable       string
+	UnavailableReason string
+}
+
+func validAction(action string) bool {
+	switch action {
+	case "", "log", "kick", "ban":
+		return true
+	}
+	return false
+}
+
+// capture returns the capture files in LogDir, pcap is empty unless
+// enabled.
+func (c *ServerConfig) capture() (text string, pcap string) {
+	text = filepath.Join(c.LogDir, "capture.log")
+	if c.CapturePcap {
+		pcap = filepath.Join(c.LogDir, "capture.pcap")
+	}
+	return text, pcap
+}
+
+// restartRequired reports whether switching from c to n needs a restart.
+func (c *ServerConfig) restartRequired(n *ServerConfig) bool {
+	return c.Config != n.Config || c.LogDir != n.LogDir || c.PlayerPoll != n.PlayerPoll ||
+		c.BanDatabase != n.BanDatabase || c.BanSync != n.BanSync || c.BanFederation != n.BanFederation ||
+		c.Capture != n.Capture || c.CapturePcap != n.CapturePcap ||
+		c.PlayerAPI != n.PlayerAPI || c.PlayerAPIOptions != n.PlayerAPIOptions || c.GeoIP != n.GeoIP ||
+		c.GeoIPASN != n.GeoIPASN || strings.Join(c.VPN.Blocklists, "\n") != strings.Join(n.VPN.Blocklists, "\n")
+}
+
+// Config is the process configuration. A file without "Servers" describes
+// a single server at the top level; otherwise the top level holds the
+// defaults every entry of "Servers" starts from.
+type Config struct {
+	ServerConfig
+	Servers        []json.RawMessage
+	BanShare       string // listen address serving BanShareFile to other servers
+	BanShareFile   string
+	BanShareTokens map[string]string // token per server name publishing to BanShare, without any only local servers may
+
+	PlayerAPIStandIn string // listen address of a local player api serving PlayerAPIFile
+	PlayerAPIFile    string
+
+	RemoteCall         string // tcp and udp listen address of the remotecall admin server, empty disables it
+	RemoteCallPassword string
+
+	servers []ServerConfig
+}
+
+// ServerList returns the resolved configuration of every server.
+func (c *Config) ServerList() []ServerConfig {
+	return c.servers
+}
+
+func (c *Config) Server(name string) (ServerConfig, bool) {
+	for _, s := range c.servers {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ServerConfig{}, false
+}
+
+// dataPath returns the default location of a runtime file in data/.
+// Files older versions kept next to the bans package are used where they
+// are until they are moved.
+func dataPath(name string) string {
+	path := filepath.Join("data", name)
+	old := filepath.Join("bans", name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(old); err == nil {
+			log.Printf("%s is deprecated, move it to %s", old, path)
+			return old
+		}
+	}
+	return path
+}
+
+func loadConfig(configpath string) (*Config, error) {
+	file, err := ioutil.ReadFile(configpath)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %v", err)
+	}
+	var config Config
+	err = json.Unmarshal(file, &config)
+	if err != nil {
+		return nil, fmt.Errorf("config error (%s): %s", configpath, err)
+	}
+	if config.BanShareFile == "" {
+		config.BanShareFile = dataPath("shared.json")
+	}
+	if config.PlayerAPIFile == "" {
+		config.PlayerAPIFile = "config/players.json"
+	}
+	if config.RemoteCall != "" && config.RemoteCallPassword == "" {
+		return nil, fmt.Errorf("config error (%s): remotecall needs a password", configpath)
+	}
+
+	if len(config.Servers) == 0 {
+		config.servers = []ServerConfig{config.ServerConfig}
+	}
+	for i, raw := range config.Servers {
+		// start from the top level defaults
+		server := config.ServerConfig
+		server.Name = ""
+		if err := json.Unmarshal(raw, &server); err != nil {
+			return nil, fmt.Errorf("config error (%s): server %d: %s", configpath, i, err)
+		}
+		config.servers = append(config.servers, server)
+	}
+
+	multi := len(config.servers) > 1
+	names := make(map[string]bool)
+	databases := make(map[string]string)
+	for i := range config.servers {
+		s := &config.servers[i]
+		if s.Server == "" {
+			return nil, fmt.Errorf("config error (%s): server %d has no address", configpath, i)
+		}
+		if s.Name == "" {
+			s.Name = s.Server
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("config error (%s): duplicate server name (%s)", configpath, s.Name)
+		}
+		names[s.Name] = true
+		if s.ChatFilter == "" {
+			s.ChatFilter = "filter/chat.txt"
+		}
+		switch {
+		case s.LogDir == "" && multi:
+			s.LogDir = filepath.Join("logs", s.Name)
+		case s.LogDir == "":
+			s.LogDir = "logs"
+		}
+		if s.BanDatabase == "" || (multi && s.BanDatabase == config.BanDatabase) {
+			if multi {
+				s.BanDatabase = dataPath(s.Name + ".json")
+			} else {
+				s.BanDatabase = dataPath("bans.json")
+			}
+		}
+		if other, ok := databases[s.BanDatabase]; ok {
+			return nil, fmt.Errorf("config error (%s): servers %s and %s share ban database %s", configpath, other, s.Name, s.BanDatabase)
+		}
+		databases[s.BanDatabase] = s.Name
+		if s.PlayerAPI != "" && !strings.Contains(s.PlayerAPI, "%s") {
+			return nil, fmt.Errorf("config error (%s): player api url of %s has no %%s for the guid", configpath, s.Name)
+		}
+		if !validAction(s.Enforcement.CentralBan) || !validAction(s.Enforcement.VACBan) {
+			return nil, fmt.Errorf("config error (%s): invalid enforcement action of %s", configpath, s.Name)
+		}
+		// an outage of the player api must not ban anyone for good
+		if s.Enforcement.Unavailable != "" && s.Enforcement.Unavailable != "log" && s.Enforcement.Unavailable != "kick" {
+			return nil, fmt.Errorf("config error (%s): enforcement of %s while the player api is unavailable has to be empty, log or kick", configpath, s.Name)
+		}
+		if s.Enforcement.CentralBanReason == "" {
+			s.Enforcement.CentralBanReason = "Central ban"
+		}
+		if s.Enforcement.VACBanReason == "" {
+			s.Enforcement.VACBanReason = "VAC ban"
+		}
+		switch s.Country.Action {
+		case "", "log", "kick":
+		default:
+			return nil, fmt.Errorf("config error (%s): invalid country action of %s", configpath, s.Name)
+		}
+		if s.Country.Action != "" && s.GeoIP == "" {
+			return nil, fmt.Errorf("config error (%s): country restriction of %s needs a GeoIP database", configpath, s.Name)
+		}
+		if s.Country.Reason == "" {
+			s.Country.Reason = "Country restriction ({country})"
+		}
+		switch s.VPN.Action {
+		case "", "log", "warn", "kick":
+		default:
+			return nil, fmt.Errorf("config error (%s): invalid vpn action of %s", configpath, s.Name)
+		}
+		if s.VPN.Action != "" && len(s.VPN.Blocklists) == 0 {
+			return nil, fmt.Errorf("config error (%s): vpn check of %s has no blocklists", configpath, s.Name)
+		}
+		if s.VPN.Reason == "" {
+			s.VPN.Reason = "VPN or hosting network"
+		}
+		if s.Enforcement.UnavailableReason == "" {
+			s.Enforcement.UnavailableReason = "Player check unavailable, try again later"
+		}
+		for _, src := range s.BanSources {
+			if src.Location == "" {
+				return nil, fmt.Errorf("config error (%s): ban source %s of %s has no location", configpath, src.Name, s.Name)
+			}
+		}
+	}
+	return &config, nil
+}
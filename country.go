@@ -0,0 +1,70 @@
+package main
+
+import (
+	"ghosthunter/players"
+	"strconv"
+	"strings"
+)
+
+// allowed reports whether players from country may join.
+func (r *CountryRestriction) allowed(country string) bool {
+	if country == "" {
+		return r.AllowUnknown
+	}
+	if contains(r.Deny, country) {
+		return false
+	}
+	return len(r.Allow) == 0 || contains(r.Allow, country)
+}
+
+// reason expands {country}, {id}, {name} and {guid} in Reason for a
+// player kept out by the restriction. Without a database match the
+// country reads "unknown".
+func (r *CountryRestriction) reason(p players.Player, country string) string {
+	if country == "" {
+		country = "unknown"
+	}
+	return strings.NewReplacer(
+		"{country}", country,
+		"{id}", strconv.Itoa(p.ID),
+		"{name}", p.Name,
+		"{guid}", p.GUID,
+	).Replace(r.Reason)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// country resolves the country of ip, empty without a database or if it
+// is unknown.
+func (s *Server) country(ip string) string {
+	if s.geo == nil || ip == "" {
+		return ""
+	}
+	country, err := s.geo.Country(ip)
+	if err != nil {
+		s.errors <- err
+	}
+	return country
+}
+
+// checkCountry applies the country restriction to a player whose GUID is
+// known and reports whether the player has been removed.
+func (s *Server) checkCountry(p players.Player, dryRun bool) bool {
+	config, _ := s.settings()
+	r := config.Country
+	if s.geo == nil || r.Action == "" || p.BypassCountry || contains(r.Whitelist, p.GUID) {
+		return false
+	}
+	country := s.country(p.IP)
+	if r.allowed(country) {
+		return false
+	}
+	return s.enforce("GEO", p, r.Action, r.reason(p, country), 0, dryRun)
+}
@@ -0,0 +1,456 @@
+// Package emulator is a local BattlEye RCon server for exercising the
+// client without a running game server. It accepts logins, answers
+// commands, pushes server messages that have to be acknowledged and can
+// lose, reorder, duplicate or hold back packets on purpose.
+package emulator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"ghosthunter/battleye"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxPayload     = 1024
+	DefaultAckTimeout     = 2 * time.Second
+	DefaultMessageRetries = 5
+	DefaultClientTimeout  = 45 * time.Second
+)
+
+// Faults describes how badly the emulated network behaves. Every
+// probability is between 0 and 1 and applies to each packet on its own.
+type Faults struct {
+	Loss      float64       // drop incoming and outgoing packets
+	Duplicate float64       // send outgoing packets twice
+	Reorder   float64       // hold outgoing packets back by Delay
+	Delay     time.Duration // 0 means 200ms
+}
+
+type Config struct {
+	Addr           string // listen address, "127.0.0.1:0" picks a free port
+	Password       string
+	MaxPayload     int           // bytes per command reply before it is split
+	AckTimeout     time.Duration // resend unacknowledged messages after
+	MessageRetries int           // drop clients that do not acknowledge
+	ClientTimeout  time.Duration // drop clients that stay silent
+	Faults         Faults
+	Logger         *log.Logger
+}
+
+// Handler answers a command. The returned text is split into a multipart
+// reply if it does not fit into one packet.
+type Handler func(command string) string
+
+// Step is a scripted server message sent After the previous one.
+type Step struct {
+	After   time.Duration
+	Message string
+}
+
+type Server struct {
+	cfg      Config
+	con      *net.UDPConn
+	log      *log.Logger
+	handlers map[string]Handler
+	clients  map[string]*client
+	commands []string
+	silence  time.Time
+	mutex    *sync.Mutex
+}
+
+type client struct {
+	addr     *net.UDPAddr
+	seen     time.Time
+	sequence byte
+	unacked  map[byte]*message
+	replies  map[byte]*reply
+	newest   byte // newest command sequence, see reply
+}
+
+type message struct {
+	packet   []byte
+	sent     time.Time
+	attempts int
+}
+
+// reply remembers the answer to a command so that a resent command is
+// answered again without running it twice, also while later commands are
+// in flight. Clients keep half of the sequence numbers unused, so a reply
+// is dropped once it is 128 or more behind the newest command; after the
+// counter wraps the same command has to be run again.
+type reply struct {
+	command string
+	packets [][]byte
+}
+
+// New opens the listening socket. Run has to be called to serve clients.
+func New(cfg Config) (*Server, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:2302"
+	}
+	if cfg.MaxPayload <= 0 {
+		cfg.MaxPayload = DefaultMaxPayload
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = DefaultAckTimeout
+	}
+	if cfg.MessageRetries <= 0 {
+		cfg.MessageRetries = DefaultMessageRetries
+	}
+	if cfg.ClientTimeout <= 0 {
+		cfg.ClientTimeout = DefaultClientTimeout
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	con, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	return &Server{
+		cfg:      cfg,
+		con:      con,
+		log:      logger,
+		handlers: make(map[string]Handler),
+		clients:  make(map[string]*client),
+		mutex:    &sync.Mutex{},
+	}, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.con.LocalAddr().String()
+}
+
+// Handle registers h for every command whose first word is name. The
+// empty name is the keep alive packet of the client.
+func (s *Server) Handle(name string, h Handler) {
+	s.mutex.Lock()
+	s.handlers[name] = h
+	s.mutex.Unlock()
+}
+
+// Reply registers a fixed response for a command.
+func (s *Server) Reply(name string, response string) {
+	s.Handle(name, func(string) string {
+		return response
+	})
+}
+
+// SetFaults changes the network behaviour while the server is running.
+func (s *Server) SetFaults(f Faults) {
+	s.mutex.Lock()
+	s.cfg.Faults = f
+	s.mutex.Unlock()
+}
+
+// Faults returns the current network behaviour.
+func (s *Server) Faults() Faults {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cfg.Faults
+}
+
+// Silence ignores every packet and sends nothing for d.
+func (s *Server) Silence(d time.Duration) {
+	s.mutex.Lock()
+	s.silence = time.Now().Add(d)
+	s.mutex.Unlock()
+}
+
+// Commands returns every command that has been run, in order.
+func (s *Server) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Clients returns the number of logged in clients.
+func (s *Server) Clients() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.clients)
+}
+
+// Unacked returns the number of server messages still waiting for an
+// acknowledgement.
+func (s *Server) Unacked() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, c := range s.clients {
+		n += len(c.unacked)
+	}
+	return n
+}
+
+// Push sends a server message to every logged in client.
+func (s *Server) Push(text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.clients {
+		packet := battleye.NewBEServerMessage()
+		packet.Sequence = c.sequence
+		packet.Message = text
+		bytes, err := packet.Marshal()
+		if err != nil {
+			s.log.Println(err)
+			continue
+		}
+		c.unacked[c.sequence] = &message{packet: bytes, sent: time.Now(), attempts: 1}
+		c.sequence++
+		s.send(c.addr, bytes)
+	}
+}
+
+// Play pushes the steps of a script until it ends or ctx is done.
+func (s *Server) Play(ctx context.Context, script []Step) {
+	for _, step := range script {
+		select {
+		case <-time.After(step.After):
+			s.Push(step.Message)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ParseScript reads a script of "<seconds> <message>" lines. Empty lines
+// and lines starting with # are skipped.
+func ParseScript(r io.Reader) ([]Step, error) {
+	var script []Step
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		seconds, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("invalid script line %d (%s)", n, line)
+		}
+		script = append(script, Step{After: time.Duration(seconds * float64(time.Second)), Message: fields[1]})
+	}
+	return script, scanner.Err()
+}
+
+// Run serves clients until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		s.con.Close()
+	}()
+	go s.maintain(done)
+
+	var buf [4096]byte
+	for {
+		n, addr, err := s.con.ReadFromUDP(buf[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		s.receive(addr, packet)
+	}
+}
+
+// maintain resends unacknowledged messages and drops dead clients.
+func (s *Server) maintain(done chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			if now.Before(s.silence) {
+				s.mutex.Unlock()
+				continue
+			}
+			for key, c := range s.clients {
+				if now.Sub(c.seen) > s.cfg.ClientTimeout {
+					s.log.Printf("%s timed out", key)
+					delete(s.clients, key)
+					continue
+				}
+				for seq, m := range c.unacked {
+					if now.Sub(m.sent) < s.cfg.AckTimeout {
+						continue
+					}
+					if m.attempts >= s.cfg.MessageRetries {
+						s.log.Printf("%s did not acknowledge message %d", key, seq)
+						delete(s.clients, key)
+						break
+					}
+					m.attempts++
+					m.sent = now
+					s.send(c.addr, m.packet)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+func (s *Server) receive(addr *net.UDPAddr, packet []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Now().Before(s.silence) || s.roll(s.cfg.Faults.Loss) {
+		return
+	}
+
+	decoded, err := battleye.DecodeFrom(battleye.FromClient, packet)
+	if err != nil {
+		s.log.Printf("%s sent garbage (%x): %v", addr, packet, err)
+		return
+	}
+
+	key := addr.String()
+	c := s.clients[key]
+	if c != nil {
+		c.seen = time.Now()
+	}
+	switch p := decoded.(type) {
+	case *battleye.BEClientLogin:
+		response := battleye.NewBEServerLogin()
+		if p.Password == s.cfg.Password {
+			response.LoginResponse = 0x01
+			s.clients[key] = &client{
+				addr:    addr,
+				seen:    time.Now(),
+				unacked: make(map[byte]*message),
+				replies: make(map[byte]*reply),
+			}
+			s.log.Printf("%s logged in", key)
+		} else {
+			delete(s.clients, key)
+			s.log.Printf("%s used a wrong password", key)
+		}
+		bytes, err := response.Marshal()
+		if err == nil {
+			s.send(addr, bytes)
+		}
+	case *battleye.BEClientCommand:
+		if c == nil {
+			return
+		}
+		if len(c.replies) == 0 || p.Sequence-c.newest < 128 {
+			c.newest = p.Sequence
+		}
+		for seq := range c.replies {
+			if c.newest-seq >= 128 {
+				delete(c.replies, seq)
+			}
+		}
+		r := c.replies[p.Sequence]
+		if r == nil || r.command != p.Command {
+			r = &reply{command: p.Command, packets: s.answer(p.Sequence, p.Command)}
+			c.replies[p.Sequence] = r
+		}
+		for _, packet := range r.packets {
+			s.send(addr, packet)
+		}
+	case *battleye.BEClientMessage:
+		if c == nil {
+			return
+		}
+		delete(c.unacked, p.Sequence)
+	}
+}
+
+// answer runs a command and encodes the reply packets.
+func (s *Server) answer(seq byte, command string) [][]byte {
+	if command != "" {
+		s.commands = append(s.commands, command)
+		s.log.Printf("command %d (%s)", seq, command)
+	}
+	name := strings.SplitN(command, " ", 2)[0]
+	response := ""
+	if h, ok := s.handlers[name]; ok {
+		response = h(command)
+	} else if command != "" {
+		response = "Unknown command"
+	}
+
+	// split at the payload limit, BattlEye counts parts in one byte
+	var parts []string
+	for len(response) > s.cfg.MaxPayload && len(parts) < 254 {
+		parts = append(parts, response[:s.cfg.MaxPayload])
+		response = response[s.cfg.MaxPayload:]
+	}
+	parts = append(parts, response)
+
+	var packets [][]byte
+	for i, part := range parts {
+		packet := battleye.NewBEServerCommand()
+		packet.Sequence = seq
+		packet.Response = part
+		if len(parts) > 1 {
+			packet.OptionalHeader = &battleye.BEOptionalHeader{MagicByte: 0x00, NumberOfPackets: byte(len(parts)), Index: byte(i)}
+		}
+		bytes, err := packet.Marshal()
+		if err != nil {
+			s.log.Println(err)
+			continue
+		}
+		packets = append(packets, bytes)
+	}
+	return packets
+}
+
+// send writes a packet subject to the configured faults. The caller holds
+// the mutex.
+func (s *Server) send(addr *net.UDPAddr, packet []byte) {
+	f := s.cfg.Faults
+	if time.Now().Before(s.silence) || s.roll(f.Loss) {
+		return
+	}
+	copies := 1
+	if s.roll(f.Duplicate) {
+		copies = 2
+	}
+	if s.roll(f.Reorder) {
+		delay := f.Delay
+		if delay <= 0 {
+			delay = 200 * time.Millisecond
+		}
+		time.AfterFunc(delay, func() {
+			for i := 0; i < copies; i++ {
+				s.con.WriteToUDP(packet, addr)
+			}
+		})
+		return
+	}
+	for i := 0; i < copies; i++ {
+		s.con.WriteToUDP(packet, addr)
+	}
+}
+
+func (s *Server) roll(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
@@ -0,0 +1,147 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"ghosthunter/battleye"
+	"net"
+	"testing"
+	"time"
+)
+
+// dial starts a server and returns a raw udp connection to it.
+func dial(t *testing.T, cfg Config) (*Server, net.Conn) {
+	t.Helper()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.Password = "test"
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Run(ctx)
+	con, err := net.Dial("udp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Close() })
+	return server, con
+}
+
+func write(t *testing.T, con net.Conn, p battleye.BEPacket) {
+	t.Helper()
+	raw, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := con.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, con net.Conn) battleye.BEPacket {
+	t.Helper()
+	con.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := con.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := battleye.Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func login(t *testing.T, con net.Conn, password string) byte {
+	t.Helper()
+	p := battleye.NewBEClientLogin()
+	p.Password = password
+	write(t, con, p)
+	reply, ok := read(t, con).(*battleye.BEServerLogin)
+	if !ok {
+		t.Fatalf("got %#v, want a login reply", reply)
+	}
+	return reply.LoginResponse
+}
+
+// command sends a command and returns the reply.
+func command(t *testing.T, con net.Conn, seq byte, text string) string {
+	t.Helper()
+	p := battleye.NewBEClientCommand()
+	p.Sequence = seq
+	p.Command = text
+	write(t, con, p)
+	reply, ok := read(t, con).(*battleye.BEServerCommand)
+	if !ok || reply.Sequence != seq {
+		t.Fatalf("got %#v, want the reply to %d", reply, seq)
+	}
+	return reply.Response
+}
+
+func TestLogin(t *testing.T) {
+	server, con := dial(t, Config{})
+	if login(t, con, "wrong") != 0x00 || server.Clients() != 0 {
+		t.Error("logged in with a wrong password")
+	}
+	if login(t, con, "test") != 0x01 || server.Clients() != 1 {
+		t.Error("login failed")
+	}
+}
+
+func TestResentCommands(t *testing.T) {
+	server, con := dial(t, Config{})
+	runs := 0
+	server.Handle("count", func(string) string {
+		runs++
+		return fmt.Sprint(runs)
+	})
+	login(t, con, "test")
+
+	// pipelined commands, the first one is resent
+	for seq := byte(0); seq < 3; seq++ {
+		command(t, con, seq, "count")
+	}
+	if got := command(t, con, 0, "count"); got != "1" || len(server.Commands()) != 3 {
+		t.Errorf("resent command answered %q after %q", got, server.Commands())
+	}
+	// a different command is new even with the same sequence
+	if got := command(t, con, 1, "count again"); got != "4" {
+		t.Errorf("new command answered %q", got)
+	}
+
+	// once the counter has moved on by half, the sequence is used again
+	command(t, con, 64, "count")
+	command(t, con, 130, "count")
+	if got := command(t, con, 2, "count"); got != "7" {
+		t.Errorf("command after the counter wrapped answered %q", got)
+	}
+	if len(server.Commands()) != 7 {
+		t.Errorf("commands %q", server.Commands())
+	}
+}
+
+func TestMessagesResent(t *testing.T) {
+	server, con := dial(t, Config{AckTimeout: 100 * time.Millisecond})
+	login(t, con, "test")
+	server.Push("hello")
+
+	for i := 0; i < 2; i++ {
+		m, ok := read(t, con).(*battleye.BEServerMessage)
+		if !ok || m.Sequence != 0 || m.Message != "hello" {
+			t.Fatalf("got %#v", m)
+		}
+	}
+	ack := battleye.NewBEClientMessage()
+	ack.Sequence = 0
+	write(t, con, ack)
+	deadline := time.Now().Add(3 * time.Second)
+	for server.Unacked() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledged message still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+package events
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Channel string
+
+const (
+	Global  Channel = "Global"
+	Side    Channel = "Side"
+	Vehicle Channel = "Vehicle"
+	Direct  Channel = "Direct"
+	Group   Channel = "Group"
+	Command Channel = "Command"
+)
+
+// Event is a parsed battleye.BEServerMessage.
+type Event interface {
+	Line() string
+}
+
+type PlayerConnected struct {
+	Raw  string
+	ID   int
+	Name string
+	IP   string
+	Port int
+}
+
+type PlayerGUIDUnverified struct {
+	Raw  string
+	ID   int
+	Name string
+	GUID string
+}
+
+type PlayerGUIDVerified struct {
+	Raw  string
+	ID   int
+	Name string
+	GUID string
+}
+
+type PlayerDisconnected struct {
+	Raw  string
+	ID   int
+	Name string
+}
+
+type PlayerKicked struct {
+	Raw    string
+	ID     int
+	Name   string
+	GUID   string // "-" if the GUID was not known yet
+	Kicker string
+	Reason string
+}
+
+// FilterKick is a kick issued by a BattlEye filter, e.g.
+// "Script Restriction #12".
+type FilterKick struct {
+	PlayerKicked
+	Filter string
+	Number int
+	Detail string
+}
+
+// PlayerBanned is a kick caused by a ban, e.g. "Admin Ban (cheating)"
+// or "Global Ban #1a2b3c".
+type PlayerBanned struct {
+	PlayerKicked
+	Global bool
+}
+
+type ChatMessage struct {
+	Raw     string
+	Channel Channel
+	Sender  string
+	Text    string
+}
+
+type RConAdminLogin struct {
+	Raw  string
+	ID   int
+	IP   string
+	Port int
+}
+
+// Unknown is any line no other event matches.
+type Unknown struct {
+	Raw string
+}
+
+func (e PlayerConnected) Line() string      { return e.Raw }
+func (e PlayerGUIDUnverified) Line() string { return e.Raw }
+func (e PlayerGUIDVerified) Line() string   { return e.Raw }
+func (e PlayerDisconnected) Line() string   { return e.Raw }
+func (e PlayerKicked) Line() string         { return e.Raw }
+func (e ChatMessage) Line() string          { return e.Raw }
+func (e RConAdminLogin) Line() string       { return e.Raw }
+func (e Unknown) Line() string              { return e.Raw }
+
+var (
+	reChat       = regexp.MustCompile(`^\((Global|Side|Vehicle|Direct|Group|Command)\) (.+?): (.*)$`)
+	reConnected  = regexp.MustCompile(`^Player #(\d{1,3}) (.*) \((\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{1,5})\) connected$`)
+	reUnverified = regexp.MustCompile(`^Player #(\d{1,3}) (.*) - (?:BE )?GUID: ([a-f0-9]{32}) \(unverified\)$`)
+	reVerified   = regexp.MustCompile(`^Verified GUID \(([a-f0-9]{32})\) of player #(\d{1,3}) (.*)$`)
+	reDisconnect = regexp.MustCompile(`^Player #(\d{1,3}) (.*) disconnected$`)
+	reKicked     = regexp.MustCompile(`^Player #(\d{1,3}) (.*) \(([a-f0-9]{32}|-)\) has been kicked by (.+?): (.*)$`)
+	reAdminLogin = regexp.MustCompile(`^RCon admin #(\d+) \((\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{1,5})\) logged in$`)
+	reRestrict   = regexp.MustCompile(`^(.+ Restriction) #(\d+)(?: (.*))?$`)
+	reBan        = regexp.MustCompile(`^(?:(Admin|Global) Ban\b|Banned\b)`)
+)
+
+// Parse turns a BattlEye server message into a typed event. Lines that
+// match no known format are returned as Unknown.
+func Parse(line string) Event {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "(") {
+		if m := reChat.FindStringSubmatch(line); m != nil {
+			return ChatMessage{Raw: line, Channel: Channel(m[1]), Sender: m[2], Text: m[3]}
+		}
+		return Unknown{Raw: line}
+	}
+	if m := reConnected.FindStringSubmatch(line); m != nil {
+		return PlayerConnected{Raw: line, ID: atoi(m[1]), Name: m[2], IP: m[3], Port: atoi(m[4])}
+	}
+	if m := reUnverified.FindStringSubmatch(line); m != nil {
+		return PlayerGUIDUnverified{Raw: line, ID: atoi(m[1]), Name: m[2], GUID: m[3]}
+	}
+	if m := reVerified.FindStringSubmatch(line); m != nil {
+		return PlayerGUIDVerified{Raw: line, ID: atoi(m[2]), Name: m[3], GUID: m[1]}
+	}
+	if m := reKicked.FindStringSubmatch(line); m != nil {
+		kick := PlayerKicked{Raw: line, ID: atoi(m[1]), Name: m[2], GUID: m[3], Kicker: m[4], Reason: m[5]}
+		if r := reRestrict.FindStringSubmatch(kick.Reason); r != nil {
+			return FilterKick{PlayerKicked: kick, Filter: r[1], Number: atoi(r[2]), Detail: r[3]}
+		}
+		if b := reBan.FindStringSubmatch(kick.Reason); b != nil {
+			return PlayerBanned{PlayerKicked: kick, Global: b[1] == "Global"}
+		}
+		return kick
+	}
+	if m := reDisconnect.FindStringSubmatch(line); m != nil {
+		return PlayerDisconnected{Raw: line, ID: atoi(m[1]), Name: m[2]}
+	}
+	if m := reAdminLogin.FindStringSubmatch(line); m != nil {
+		return RConAdminLogin{Raw: line, ID: atoi(m[1]), IP: m[2], Port: atoi(m[3])}
+	}
+	return Unknown{Raw: line}
+}
+
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return i
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	kick := func(line string, id int, name, guid, kicker, reason string) PlayerKicked {
+		return PlayerKicked{Raw: line, ID: id, Name: name, GUID: guid, Kicker: kicker, Reason: reason}
+	}
+	const guid = "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		line string
+		want Event
+	}{
+		{
+			"Player #3 John Doe (203.0.113.7:2304) connected",
+			PlayerConnected{Raw: "Player #3 John Doe (203.0.113.7:2304) connected", ID: 3, Name: "John Doe", IP: "203.0.113.7", Port: 2304},
+		},
+		{
+			"Player #3 John Doe - BE GUID: " + guid + " (unverified)",
+			PlayerGUIDUnverified{Raw: "Player #3 John Doe - BE GUID: " + guid + " (unverified)", ID: 3, Name: "John Doe", GUID: guid},
+		},
+		{
+			// older servers leave out "BE"
+			"Player #3 John Doe - GUID: " + guid + " (unverified)",
+			PlayerGUIDUnverified{Raw: "Player #3 John Doe - GUID: " + guid + " (unverified)", ID: 3, Name: "John Doe", GUID: guid},
+		},
+		{
+			"Verified GUID (" + guid + ") of player #3 John Doe",
+			PlayerGUIDVerified{Raw: "Verified GUID (" + guid + ") of player #3 John Doe", ID: 3, Name: "John Doe", GUID: guid},
+		},
+		{
+			"Player #3 John Doe disconnected",
+			PlayerDisconnected{Raw: "Player #3 John Doe disconnected", ID: 3, Name: "John Doe"},
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: Client not responding",
+			kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: Client not responding", 3, "John Doe", guid, "BattlEye", "Client not responding"),
+		},
+		{
+			"Player #3 John Doe (-) has been kicked by BattlEye: Admin Kick (afk)",
+			kick("Player #3 John Doe (-) has been kicked by BattlEye: Admin Kick (afk)", 3, "John Doe", "-", "BattlEye", "Admin Kick (afk)"),
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: Script Restriction #12",
+			FilterKick{
+				PlayerKicked: kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: Script Restriction #12", 3, "John Doe", guid, "BattlEye", "Script Restriction #12"),
+				Filter:       "Script Restriction",
+				Number:       12,
+			},
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: RemoteExec Restriction #4 \"bis_fnc_execvm\"",
+			FilterKick{
+				PlayerKicked: kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: RemoteExec Restriction #4 \"bis_fnc_execvm\"", 3, "John Doe", guid, "BattlEye", "RemoteExec Restriction #4 \"bis_fnc_execvm\""),
+				Filter:       "RemoteExec Restriction",
+				Number:       4,
+				Detail:       "\"bis_fnc_execvm\"",
+			},
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: Admin Ban (cheating)",
+			PlayerBanned{PlayerKicked: kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: Admin Ban (cheating)", 3, "John Doe", guid, "BattlEye", "Admin Ban (cheating)")},
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: Global Ban #1a2b3c",
+			PlayerBanned{PlayerKicked: kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: Global Ban #1a2b3c", 3, "John Doe", guid, "BattlEye", "Global Ban #1a2b3c"), Global: true},
+		},
+		{
+			"Player #3 John Doe (" + guid + ") has been kicked by BattlEye: Banned",
+			PlayerBanned{PlayerKicked: kick("Player #3 John Doe ("+guid+") has been kicked by BattlEye: Banned", 3, "John Doe", guid, "BattlEye", "Banned")},
+		},
+		{
+			"(Global) John Doe: hello: world",
+			ChatMessage{Raw: "(Global) John Doe: hello: world", Channel: Global, Sender: "John Doe", Text: "hello: world"},
+		},
+		{
+			"(Side) John Doe: push north",
+			ChatMessage{Raw: "(Side) John Doe: push north", Channel: Side, Sender: "John Doe", Text: "push north"},
+		},
+		{
+			"(Vehicle) John Doe: get in",
+			ChatMessage{Raw: "(Vehicle) John Doe: get in", Channel: Vehicle, Sender: "John Doe", Text: "get in"},
+		},
+		{
+			"(Direct) John Doe: hands up",
+			ChatMessage{Raw: "(Direct) John Doe: hands up", Channel: Direct, Sender: "John Doe", Text: "hands up"},
+		},
+		{
+			"(Group) John Doe: regroup",
+			ChatMessage{Raw: "(Group) John Doe: regroup", Channel: Group, Sender: "John Doe", Text: "regroup"},
+		},
+		{
+			"(Command) John Doe: hold",
+			ChatMessage{Raw: "(Command) John Doe: hold", Channel: Command, Sender: "John Doe", Text: "hold"},
+		},
+		{
+			"RCon admin #0 (127.0.0.1:52814) logged in",
+			RConAdminLogin{Raw: "RCon admin #0 (127.0.0.1:52814) logged in", ID: 0, IP: "127.0.0.1", Port: 52814},
+		},
+		{
+			"(Unknown) John Doe: hi",
+			Unknown{Raw: "(Unknown) John Doe: hi"},
+		},
+		{
+			"Ban check timed out, no response from BE Master",
+			Unknown{Raw: "Ban check timed out, no response from BE Master"},
+		},
+	}
+	for _, test := range tests {
+		got := Parse(test.line + "\r\n")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q)\n got %#v\nwant %#v", test.line, got, test.want)
+		}
+	}
+}
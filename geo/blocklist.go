@@ -0,0 +1,99 @@
+package geo
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Blocklist holds networks read from text files with one entry per line:
+// a CIDR range, a single address or an AS number like "AS16509".
+// Anything after # is a comment.
+type Blocklist struct {
+	ranges []blockedRange
+	asns   map[uint]string // AS number to the file listing it
+}
+
+type blockedRange struct {
+	network *net.IPNet
+	source  string
+}
+
+// LoadBlocklist reads and merges blocklist files.
+func LoadBlocklist(filenames ...string) (*Blocklist, error) {
+	b := &Blocklist{asns: make(map[uint]string)}
+	for _, filename := range filenames {
+		if err := b.load(filename); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Blocklist) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("blocklist error (%s): %v", filename, err)
+	}
+	defer f.Close()
+	source := filepath.Base(filename)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) > 2 && strings.EqualFold(line[:2], "AS") {
+			asn, err := strconv.ParseUint(line[2:], 10, 32)
+			if err != nil {
+				return fmt.Errorf("blocklist error (%s): invalid AS number on line %d (%s)", filename, n, line)
+			}
+			b.asns[uint(asn)] = source
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("blocklist error (%s): invalid range on line %d (%s)", filename, n, line)
+		}
+		b.ranges = append(b.ranges, blockedRange{network: network, source: source})
+	}
+	return scanner.Err()
+}
+
+// Match returns the name of the file listing ip or its AS number asn. An
+// asn of 0 is unknown and never matches.
+func (b *Blocklist) Match(ip string, asn uint) (string, bool) {
+	if source, ok := b.asns[asn]; ok && asn != 0 {
+		return source, true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false
+	}
+	for _, r := range b.ranges {
+		if r.network.Contains(addr) {
+			return r.source, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of ranges and AS numbers.
+func (b *Blocklist) Len() (ranges int, asns int) {
+	return len(b.ranges), len(b.asns)
+}
@@ -0,0 +1,77 @@
+// Package geo resolves IP addresses offline from MaxMind format (mmdb)
+// databases.
+package geo
+
+import (
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+)
+
+// ASN is the autonomous system an address belongs to.
+type ASN struct {
+	Number       uint
+	Organization string
+}
+
+// DB is a country database.
+type DB struct {
+	country *geoip2.Reader
+}
+
+func Open(filename string) (*DB, error) {
+	country, err := geoip2.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("geoip (%s): %v", filename, err)
+	}
+	return &DB{country: country}, nil
+}
+
+// Country returns the ISO 3166 code of the country ip is located in, empty
+// if the database does not know the address.
+func (d *DB) Country(ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("geoip: invalid ip (%s)", ip)
+	}
+	record, err := d.country.Country(addr)
+	if err != nil {
+		return "", fmt.Errorf("geoip (%s): %v", ip, err)
+	}
+	return record.Country.IsoCode, nil
+}
+
+func (d *DB) Close() error {
+	return d.country.Close()
+}
+
+// ASNDB is an autonomous system database.
+type ASNDB struct {
+	asn *geoip2.Reader
+}
+
+func OpenASN(filename string) (*ASNDB, error) {
+	asn, err := geoip2.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("geoip asn (%s): %v", filename, err)
+	}
+	return &ASNDB{asn: asn}, nil
+}
+
+// Lookup returns the autonomous system of ip, the zero ASN if the database
+// does not know the address.
+func (d *ASNDB) Lookup(ip string) (ASN, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ASN{}, fmt.Errorf("geoip asn: invalid ip (%s)", ip)
+	}
+	record, err := d.asn.ASN(addr)
+	if err != nil {
+		return ASN{}, fmt.Errorf("geoip asn (%s): %v", ip, err)
+	}
+	return ASN{Number: record.AutonomousSystemNumber, Organization: record.AutonomousSystemOrganization}, nil
+}
+
+func (d *ASNDB) Close() error {
+	return d.asn.Close()
+}
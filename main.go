@@ -8,50 +8,25 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"ghosthunter/api"
-	"ghosthunter/battleye"
+	"ghosthunter/bans"
+	"ghosthunter/remotecall"
 	"ghosthunter/udp"
-	//"github.com/alecthomas/geoip"
 	"github.com/daviddengcn/go-colortext"
-	"io/ioutil"
 	"log"
-	//"net"
 	"net/http"
 	//_ "net/http/pprof"
 	"os"
-	"regexp"
+	"os/signal"
 	"runtime"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-var (
-	client *udp.UDPClient
-)
-
-const (
-	HTTP_API_URL = "http://xxx.xxx.fankservercdn.com/player.api.html?BattlEyeGUID=%s"
-)
-
-type Detection struct {
-	Index    uint16
-	Reaction byte
-	Format   string
-}
-
-type Chatfilter struct {
-	Filename   string
-	Detections []Detection
-}
-
-func NewChatfilter(file string) *Chatfilter {
-	return &Chatfilter{Filename: file}
-}
-
 func main() {
 	// enable usage of all cpu cores
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -63,72 +38,78 @@ func main() {
 
 	// json config
 	configpath := flag.String("config", "default.json", "json config file")
+	capture := flag.String("replay", "", "replay a capture file offline and exit")
+	name := flag.String("server", "", "server whose config -replay uses")
 	flag.Parse()
 	*configpath = fmt.Sprintf("config/%s", *configpath)
-	// json parse
-	file, e := ioutil.ReadFile(*configpath)
-	if e != nil {
-		log.Fatalf("config error: %v\n", e)
+	// json parse and filter
+	reloader, err := NewReloader(*configpath)
+	if err != nil {
+		log.Fatalln(err)
 		return
 	}
-
-	var config udp.Config
-	perr := json.Unmarshal(file, &config)
-	if perr != nil {
-		log.Fatalf("config error (%s): %s", *configpath, perr)
+	if *capture != "" {
+		if err := replay(reloader, *name, *capture); err != nil {
+			log.Fatalln(err)
+		}
 		return
 	}
-
-	// filter
-	cfilter := NewChatfilter("filter/chat.txt")
-	err := loadChatFilter(cfilter)
-	if err != nil {
-		log.Println(err)
-	}
+	config := reloader.Current().Config
 
 	//log.Printf("%v", config)
 
-	// channels
-	kickLog, banLog, chatLog, packets, errors := make(chan string, 5), make(chan string, 5), make(chan string, 5), make(chan string, 5), make(chan error, 5)
+	errors := make(chan error, 5)
 
-	client = udp.NewUDPClient(&config)
-	go client.ProcessPendingPackets()
-	go client.Listen()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 2)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
-	go concatPackets(client.CmdIn, packets)
-
-	for i := 0; i < 5; i++ {
-		go handleMessages(client.MsgIn, chatLog, kickLog, banLog, cfilter)
+	var servers []*Server
+	for _, cfg := range config.ServerList() {
+		server, err := NewServer(cfg, reloader)
+		if err != nil {
+			log.Fatalf("%s: %v", cfg.Name, err)
+			return
+		}
+		if err := server.Start(ctx); err != nil {
+			log.Fatalf("%s: %v", cfg.Name, err)
+			return
+		}
+		servers = append(servers, server)
+	}
+
+	if config.BanShare != "" {
+		go func() {
+			errors <- http.ListenAndServe(config.BanShare, bans.SharedHandler(config.BanShareFile, config.BanShareTokens))
+		}()
+	}
+	if config.PlayerAPIStandIn != "" {
+		go func() {
+			errors <- http.ListenAndServe(config.PlayerAPIStandIn, api.StandInHandler(config.PlayerAPIFile))
+		}()
+	}
+	if config.RemoteCall != "" {
+		rc := remotecall.NewServer(remotecall.Config{
+			Password: config.RemoteCallPassword,
+			Logger:   log.New(os.Stderr, "[remotecall] ", log.LstdFlags),
+		}, remoteQuery(servers))
+		go func() {
+			if err := rc.ListenAndServe(ctx, config.RemoteCall); err != nil {
+				errors <- err
+			}
+		}()
 	}
-	go handleCommands(client, packets, kickLog, banLog, errors)
-
-	go console()
+	go reloader.Watch(ctx, 2*time.Second, errors)
+	go console(servers, reloader, errors)
 
-	// log files
-	fErr, err := os.OpenFile("logs/error.log", os.O_APPEND|os.O_WRONLY, 0600)
+	// log file
+	fErr, err := os.OpenFile("logs/error.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		log.Println(err)
 	}
 	defer fErr.Close()
 
-	fKick, err := os.OpenFile("logs/kick.log", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Println(err)
-	}
-	defer fKick.Close()
-
-	fBan, err := os.OpenFile("logs/ban.log", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Println(err)
-	}
-	defer fBan.Close()
-
-	fChat, err := os.OpenFile("logs/chat.log", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Println(err)
-	}
-	defer fChat.Close()
-
 	for {
 		select {
 		case e := <-errors:
@@ -136,317 +117,100 @@ func main() {
 			ct.ChangeColor(ct.Cyan, true, ct.Black, false)
 			log.Println(e)
 			ct.ResetColor()
-		case e := <-client.Err:
-			fErr.WriteString(time.Now().String() + " " + e.Error() + "\n")
-			ct.ChangeColor(ct.Cyan, true, ct.Black, false)
-			log.Println(e)
-			ct.ResetColor()
-		case k := <-kickLog:
-			fKick.WriteString(time.Now().String() + " " + k + "\n")
-			ct.ChangeColor(ct.Red, true, ct.Black, false)
-			log.Println(k)
-			ct.ResetColor()
-		case c := <-chatLog:
-			fChat.WriteString(time.Now().String() + " " + c + "\n")
-			//log.Println(c)
-		case b := <-banLog:
-			fBan.WriteString(time.Now().String() + " " + b + "\n")
-			ct.ChangeColor(ct.Red, true, ct.Black, false)
-			log.Println(b)
-			ct.ResetColor()
+		case sig := <-quit:
+			log.Printf("%s received, shutting down", sig)
+			cancel()
+			shutdown(servers, grace(config), quit)
+			fErr.Sync()
+			return
 		}
 	}
 }
 
-func console() {
-	reader := bufio.NewReader(os.Stdin)
-
-	for {
-		line, _ := reader.ReadString('\n')
-		if strings.HasPrefix(line, "kick") {
-			rawstr := strings.Fields(line)
-			if len(rawstr) == 2 {
-				newpkt := battleye.NewBEClientCommand()
-				newpkt.Command = fmt.Sprintf("kick %s", rawstr[1])
-				client.Out <- newpkt
-			} else if len(rawstr) == 3 {
-				//client.KickPlayerById(id int16, reason string)
-				newpkt := battleye.NewBEClientCommand()
-				newpkt.Command = fmt.Sprintf("kick %s %s", rawstr[1], rawstr[2])
-				client.Out <- newpkt
-			}
-		} else if strings.HasPrefix(line, "ping") {
-			newpkt := battleye.NewBEClientCommand()
-			newpkt.Command = fmt.Sprintf("maxping")
-			client.Out <- newpkt
-		} else if strings.HasPrefix(line, "pl") {
-			newpkt := battleye.NewBEClientCommand()
-			newpkt.Command = fmt.Sprintf("players")
-			client.Out <- newpkt
+// grace returns the longest shutdown grace period of all servers plus
+// some time to flush the logs.
+func grace(config Config) time.Duration {
+	grace := udp.DefaultShutdownGrace
+	for _, cfg := range config.ServerList() {
+		if d := time.Duration(cfg.ShutdownGrace) * time.Second; d > grace {
+			grace = d
 		}
 	}
+	return grace + 2*time.Second
 }
 
-func handleMessages(c chan battleye.BEServerMessage, chatLog, kickLog, banLog chan string, filter *Chatfilter) {
-	/*geo, err := geoip.New()
-	if err != nil {
-		log.Fatalln(err)
-	}*/
-
-	// regular expressions
-	reParseMsg := regexp.MustCompile(`^\((\w+)\) (.*): (.*)$`)
-	reParseConnected := regexp.MustCompile(`^Player #([0-9]{1,3}) (.*) \((\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{4,5})\) connected$`)
-	reParseLogin := regexp.MustCompile(`^Player #([0-9]{1,3}) (.*) - GUID: ([a-f0-9]{32}) \(unverified\)$`)
-	reParseKicked := regexp.MustCompile(`Player #(\d+) (.*) \((\w{32})\) has been kicked by (.+): (.+)`)
-
-	for {
+// shutdown waits for all servers to stop. A second signal or the end of
+// the grace period gives up on the remaining ones.
+func shutdown(servers []*Server, grace time.Duration, quit chan os.Signal) {
+	timeout := time.After(grace)
+	for _, s := range servers {
 		select {
-		case p := <-c:
-			rawstring := p.Message
-			switch {
-			case strings.HasSuffix(rawstring, "(unverified)"):
-				parsedstrings := reParseLogin.FindStringSubmatch(rawstring)
-				if len(parsedstrings) == 4 {
-					log.Printf("new player (#%s %s %s)", parsedstrings[1], parsedstrings[2], parsedstrings[3])
-					//request to api
-
-				} else {
-					client.Err <- fmt.Errorf("error parsing new player! (%s)", rawstring)
-				}
-			case strings.HasSuffix(rawstring, "connected"):
-				result := reParseConnected.FindStringSubmatch(rawstring)
-				if len(result) == 5 {
-					// get player number
-					/*tmp, err := strconv.Atoi(result[1])
-					number := int16(tmp)
-					if err != nil {
-						number = int16(-1)
-					}
-
-					// check country
-					country := geo.Lookup(net.ParseIP(result[3]))
-					switch {
-					case country == nil:
-						log.Printf("%d %s\n", number, "Unknown")
-					case country.Short == "DE":
-						fallthrough
-					case country.Short == "AT":
-						fallthrough
-					case country.Short == "CH":
-						fallthrough
-					case country.Short == "LU":
-						fallthrough
-					case false:
-						//log.Printf("%d %s\n", number, country)
-					default:
-						//client.KickPlayerById(number, "Country Restriction")
-						//log.Printf("%d %s\n", number, country)
-					}*/
-				}
-			case strings.HasPrefix(rawstring, "("):
-				ct.ChangeColor(ct.Green, true, ct.Black, false)
-				log.Printf("chatmsg (%s)", rawstring)
-				ct.ResetColor()
-				if filter != nil {
-					for _, v := range filter.Detections {
-						match, err := regexp.MatchString(v.Format, rawstring)
-						if err != nil {
-							client.Err <- err
-							continue
-						}
-						if match {
-							parsedstrings := reParseMsg.FindStringSubmatch(rawstring)
-							if len(parsedstrings) == 4 {
-								switch v.Reaction {
-								case 1:
-									chatLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								case 2:
-									log.Printf("detection #%d %s\n", v.Index, rawstring)
-								case 3:
-									log.Printf("detection #%d %s\n", v.Index, rawstring)
-									chatLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								case 4:
-									log.Printf("detection #%d %s %s\n", v.Index, rawstring, "[SIMULATED SILENT KICK]")
-									chatLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								case 5:
-									// todo kick
-									kickLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								case 6:
-									// todo kick
-									log.Printf("detection #%d %s\n", v.Index, rawstring)
-								case 7:
-									// todo kick
-									log.Printf("detection #%d %s\n", v.Index, rawstring)
-									kickLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								case 8:
-									//todo ban
-									log.Printf("detection #%d %s\n", v.Index, rawstring)
-									banLog <- fmt.Sprintf("#%d %s", v.Index, rawstring)
-								}
-							} else {
-								client.Err <- fmt.Errorf("error parsing chat message! (%s)", rawstring)
-							}
-						}
-					}
-				}
-			default:
-				parsed := reParseKicked.MatchString(rawstring)
-				if parsed {
-					kickLog <- fmt.Sprintf("#SVR %s", rawstring)
-				} else {
-					log.Printf("svmsg (%s)", rawstring)
-				}
-			}
+		case <-s.Done():
+		case <-timeout:
+			log.Printf("%s did not stop within %s", s.Name, grace)
+			return
+		case sig := <-quit:
+			log.Printf("%s received, exiting now", sig)
+			return
 		}
 	}
 }
 
-func concatPackets(c chan battleye.BEServerCommand, out chan string) {
-	packetbuffer := make([][]string, 256)
-
-	for i := range packetbuffer {
-		packetbuffer[i] = make([]string, 100)
-	}
+// console reads commands from stdin. "@name command" runs a command on
+// one server; without a prefix it runs on the only server or fails if
+// there are several.
+func console(servers []*Server, reloader *Reloader, errors chan error) {
+	reader := bufio.NewReader(os.Stdin)
 
-	//ticker := time.Tick(5 * time.Second)
 	for {
-		select {
-		case p := <-c:
-			if p.OptionalHeader != nil {
-				if packetbuffer[p.Sequence][0] == "" {
-					packetbuffer[p.Sequence][0] = "0"
-				}
-
-				packetbuffer[p.Sequence][p.OptionalHeader.Index+1] = p.Response
-
-				// increment packet counter
-				i, _ := strconv.Atoi(packetbuffer[p.Sequence][0])
-				ctr := byte(i)
-				ctr++
-
-				if ctr >= p.OptionalHeader.NumberOfPackets {
-					// we do not need to wait any longer because
-					// apparently all packets have arrived
-					var result string = ""
-					for i := byte(1); i <= p.OptionalHeader.NumberOfPackets; i++ {
-						result += packetbuffer[p.Sequence][i]
-					}
-					out <- result
-					for i := byte(1); i <= p.OptionalHeader.NumberOfPackets; i++ {
-						packetbuffer[p.Sequence][i] = ""
-					}
-					ctr = 0
-				}
-
-				packetbuffer[p.Sequence][0] = strconv.Itoa(int(ctr))
-
-			} else {
-				out <- p.Response
-			}
-			//case <-ticker:
-			// cleanup incomplete packets
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
 		}
-	}
-}
-
-func handleCommands(client *udp.UDPClient, c chan string, kickLog, banLog chan string, errors chan error) {
-	reParsePlayer := regexp.MustCompile(`(\d+)[ ]+((\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):\d{4,5})[ ]+(-?\d+)[ ]+((\w{32})(\([^)]+\))|-)[ ]+(.*)`)
-	/*geo, err := geoip.New()
-	if err != nil {
-		log.Fatalln(err)
-	}*/
-	for {
-		select {
-		case response := <-c:
-			switch {
-			case strings.HasPrefix(response, "Players on server:"):
-				response = strings.TrimPrefix(response, "Players on server:\n[#] [IP Address]:[Port] [Ping] [GUID] [Name]\n--------------------------------------------------")
-				rawslice := strings.Split(response, "\n")
-				for _, element := range rawslice {
-					result := reParsePlayer.FindStringSubmatch(element)
-					if len(result) == 9 {
-						// get player number
-						/*tmp, err := strconv.Atoi(result[1])
-						number := int16(tmp)
-						if err != nil {
-							number = int16(-1)
-						}
-
-						// check country
-						country := geo.Lookup(net.ParseIP(result[3]))
-						switch {
-						case country == nil:
-							log.Printf("%d %s\n", number, "Unknown")
-						case country.Short == "DE":
-							fallthrough
-						case country.Short == "AT":
-							fallthrough
-						case country.Short == "CH":
-							fallthrough
-						case country.Short == "LU":
-							fallthrough
-						case false:
-							//log.Printf("%d %s\n", number, country)
-						default:
-							//client.KickPlayerById(number, "Country Restriction")
-							//log.Printf("%d %s\n", number, country)
-						}*/
-
-					}
-				}
-			default:
-				ct.ChangeColor(ct.Magenta, true, ct.Black, false)
-				log.Printf("svcmd (%s)", response)
-				ct.ResetColor()
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "reload"):
+			if err := reloader.Reload(); err != nil {
+				errors <- err
+			}
+			continue
+		case strings.HasPrefix(line, "servers"):
+			for _, s := range servers {
+				log.Printf("%s", s.Name)
 			}
+			continue
 		}
-	}
-}
 
-func getPlayerRecord(beguid string) (*api.APIResponse, error) {
-	resp, err := http.Get(fmt.Sprintf(HTTP_API_URL, beguid))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var response api.APIResponse
-	err = json.Unmarshal(body, &response)
-	if err == nil {
-		return &response, nil
-	} else {
-		return nil, err
+		target, line, err := pick(servers, line)
+		if err != nil {
+			errors <- err
+			continue
+		}
+		if err := target.Command(line, target.log); err != nil {
+			errors <- fmt.Errorf("%s: %v", target.Name, err)
+		}
 	}
 }
 
-func loadChatFilter(filter *Chatfilter) error {
-	if filter != nil {
-		content, err := ioutil.ReadFile(filter.Filename)
-		if err != nil {
-			return err
-		}
-		lines := strings.Split(string(content), "\n")
-		detections := make([]Detection, len(lines))
-		for i, v := range lines {
-			raw := strings.Fields(v)
-			if len(raw) == 2 {
-				tmp := &Detection{}
-				tmp.Index = uint16(i)
-				v1, err := strconv.ParseUint(raw[0], 0, 8)
-				if err != nil {
-					tmp.Reaction = 1
-				} else {
-					tmp.Reaction = byte(v1)
+// pick returns the server a command is meant for and the command without
+// the "@name" prefix. Without a prefix it is the only server.
+func pick(servers []*Server, line string) (*Server, string, error) {
+	if strings.HasPrefix(line, "@") {
+		fields := strings.SplitN(line[1:], " ", 2)
+		for _, s := range servers {
+			if s.Name == fields[0] {
+				if len(fields) == 2 {
+					return s, fields[1], nil
 				}
-				tmp.Format = raw[1]
-				detections[i] = *tmp
+				return s, "", nil
 			}
 		}
-		filter.Detections = detections
-		return nil
+		return nil, "", fmt.Errorf("unknown server (%s)", fields[0])
+	}
+	if len(servers) != 1 {
+		return nil, "", fmt.Errorf("several servers running, use @name %s", line)
 	}
-	return fmt.Errorf("Chatfilter is nil")
+	return servers[0], line, nil
 }
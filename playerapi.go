@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"ghosthunter/api"
+	"ghosthunter/bans"
+	"ghosthunter/players"
+	"github.com/daviddengcn/go-colortext"
+	"time"
+)
+
+// admit runs the checks of a joining player once its GUID is known. Each
+// player is only checked once per session.
+func (s *Server) admit(id int, guid string, dryRun bool) {
+	first := false
+	s.registry.Update(id, guid, func(player *players.Player) {
+		first = !player.Checked
+		player.Checked = true
+	})
+	if !first {
+		return
+	}
+	failed := false
+	if s.api != nil {
+		var gone bool
+		if gone, failed = s.checkPlayer(id, guid, dryRun); gone {
+			return
+		}
+	}
+	p, ok := s.registry.Get(id)
+	if !ok || p.GUID != guid {
+		return
+	}
+	// without a record the player may well be allowed to bypass the
+	// country restriction, the unavailable policy decides alone
+	if !failed && s.checkCountry(p, dryRun) {
+		return
+	}
+	s.checkVPN(p, dryRun)
+}
+
+// screening reports whether joining players are checked at all.
+func (s *Server) screening() bool {
+	return s.api != nil || s.geo != nil || s.blocked != nil
+}
+
+// admitListed checks the players of a "players" reply that have not been
+// checked yet, those that were on the server before we connected.
+func (s *Server) admitListed(list []players.Player) {
+	if !s.screening() {
+		return
+	}
+	config, _ := s.settings()
+	dryRun := config.DryRun || s.replay
+	for _, l := range list {
+		p, ok := s.registry.Get(l.ID)
+		if !ok || p.GUID == "" || p.Checked {
+			continue
+		}
+		id, guid := p.ID, p.GUID
+		s.spawn(func() {
+			s.admit(id, guid, dryRun)
+		})
+	}
+}
+
+// checkPlayer looks up a player joining with guid and applies the
+// enforcement policy to what the player api returns. It reports whether
+// the player is gone and whether the lookup failed.
+func (s *Server) checkPlayer(id int, guid string, dryRun bool) (bool, bool) {
+	config, _ := s.settings()
+	policy := config.Enforcement
+	// the client bounds the lookup, shutdown cuts it short
+	record, err := s.api.Lookup(s.ctx, guid)
+	if err != nil && s.ctx.Err() != nil {
+		return true, true
+	}
+	var p players.Player
+	known := s.registry.Update(id, guid, func(player *players.Player) {
+		player.BypassCountry = record != nil && bool(record.ByPassCountry)
+		p = *player
+	})
+	if !known {
+		// the player has already left
+		return true, err != nil
+	}
+
+	if err != nil {
+		s.errors <- fmt.Errorf("player api (%s): %v", guid, err)
+	}
+	action, reason := policy.verdict(record, err)
+	return s.enforce("API", p, action, reason, policy.BanMinutes, dryRun), err != nil
+}
+
+// verdict returns the action and reason the policy has for the outcome
+// of a lookup. An empty action lets the player in.
+func (e *Enforcement) verdict(record *api.APIResponse, err error) (string, string) {
+	switch {
+	case err != nil:
+		return e.Unavailable, e.UnavailableReason
+	case record == nil:
+		// unknown to the player api
+	case bool(record.IsBanned):
+		return e.CentralBan, e.CentralBanReason
+	case bool(record.VACBanned && !record.ByPassVAC):
+		return e.VACBan, e.VACBanReason
+	}
+	return "", ""
+}
+
+// enforce applies an action to a player, logged with tag, and reports
+// whether the player has been removed. "warn" logs and highlights the
+// player on the console. Only the player api bans.
+func (s *Server) enforce(tag string, p players.Player, action string, reason string, minutes int, dryRun bool) bool {
+	line := fmt.Sprintf("#%s #%d %s %s (%s)", tag, p.ID, p.Name, p.GUID, reason)
+	switch {
+	case action == "log":
+		s.kickLog <- line
+	case action == "warn":
+		ct.ChangeColor(ct.Red, true, ct.Black, false)
+		s.log.Printf("warning %s", line)
+		ct.ResetColor()
+		s.kickLog <- fmt.Sprintf("%s [WARNING]", line)
+	case action == "kick" && dryRun:
+		s.kickLog <- fmt.Sprintf("%s [SIMULATED KICK]", line)
+	case action == "kick":
+		if err := s.client.KickPlayerById(int16(p.ID), reason); err != nil {
+			s.errors <- fmt.Errorf("%s kick #%d failed: %v", tag, p.ID, err)
+			s.kickLog <- fmt.Sprintf("%s [KICK FAILED]", line)
+			return false
+		}
+		s.kickLog <- fmt.Sprintf("%s [KICK]", line)
+	case action == "ban" && dryRun:
+		s.banLog <- fmt.Sprintf("%s [SIMULATED BAN %dmin]", line, minutes)
+	case action == "ban":
+		if err := s.banPlayer(p, minutes, reason); err != nil {
+			s.errors <- fmt.Errorf("%s ban #%d failed: %v", tag, p.ID, err)
+			s.banLog <- fmt.Sprintf("%s [BAN FAILED]", line)
+			return false
+		}
+		b := bans.Ban{GUID: p.GUID, IP: p.IP, Name: p.Name, Reason: reason, Issuer: "player api"}
+		if minutes > 0 {
+			b.Expires = time.Now().Add(time.Duration(minutes) * time.Minute)
+		}
+		if _, err := s.store.Add(b); err != nil {
+			s.errors <- err
+		}
+		s.banLog <- fmt.Sprintf("%s [BAN %dmin]", line, minutes)
+	default:
+		return false
+	}
+	return action != "log" && action != "warn"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"ghosthunter/api"
+	"ghosthunter/events"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnforcementVerdict(t *testing.T) {
+	records := filepath.Join(t.TempDir(), "players.json")
+	err := ioutil.WriteFile(records, []byte(`{
+		"banned": {"IsBanned": "1", "VACChecked": "1"},
+		"vac": {"VACChecked": "1", "VACBanned": "1"},
+		"vacbypass": {"VACChecked": "1", "VACBanned": "1", "ByPassVAC": "1"},
+		"both": {"IsBanned": "1", "VACChecked": "1", "VACBanned": "1", "ByPassVAC": "1"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn := httptest.NewServer(api.StandInHandler(records))
+	defer standIn.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	policy := Enforcement{
+		CentralBan:        "ban",
+		CentralBanReason:  "Central ban",
+		VACBan:            "kick",
+		VACBanReason:      "VAC ban",
+		Unavailable:       "kick",
+		UnavailableReason: "Player check unavailable",
+	}
+	tests := []struct {
+		url    string
+		guid   string
+		policy Enforcement
+		action string
+		reason string
+	}{
+		{standIn.URL, "clean", policy, "", ""},
+		{standIn.URL, "banned", policy, "ban", "Central ban"},
+		{standIn.URL, "vac", policy, "kick", "VAC ban"},
+		{standIn.URL, "vacbypass", policy, "", ""},
+		// the bypass only covers VAC bans
+		{standIn.URL, "both", policy, "ban", "Central ban"},
+		{standIn.URL, "vac", Enforcement{CentralBan: "ban"}, "", ""},
+		{down.URL, "clean", policy, "kick", "Player check unavailable"},
+		// fail open
+		{down.URL, "banned", Enforcement{CentralBan: "ban"}, "", ""},
+	}
+	for _, test := range tests {
+		client := api.NewClient(test.url+"/?BattlEyeGUID=%s", api.Options{Timeout: 1, Retries: 1, RetryDelay: 1})
+		record, err := client.Lookup(context.Background(), test.guid)
+		action, reason := test.policy.verdict(record, err)
+		if action != test.action || reason != test.reason {
+			t.Errorf("%s %s: got %q %q, want %q %q", test.url, test.guid, action, reason, test.action, test.reason)
+		}
+	}
+}
+
+func TestUnavailableNeverBans(t *testing.T) {
+	for action, valid := range map[string]bool{"": true, "kick": true, "log": true, "warn": false, "ban": false} {
+		configpath := filepath.Join(t.TempDir(), "config.json")
+		content := `{"Server": "127.0.0.1:2302", "Enforcement": {"Unavailable": "` + action + `"}}`
+		if err := ioutil.WriteFile(configpath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(configpath)
+		if (err == nil) != valid {
+			t.Errorf("Unavailable %q: got %v", action, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "unavailable") {
+			t.Errorf("Unavailable %q: unexpected error %v", action, err)
+		}
+	}
+}
+
+func TestUnavailableSkipsCountry(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	dir := t.TempDir()
+	filter := filepath.Join(dir, "chat.txt")
+	if err := ioutil.WriteFile(filter, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	configpath := filepath.Join(dir, "config.json")
+	content := `{"Server": "127.0.0.1:2302", "Name": "altis1", "ChatFilter": "` + filter + `",
+		"BanDatabase": "` + filepath.Join(dir, "bans.json") + `",
+		"PlayerAPI": "` + down.URL + `/?BattlEyeGUID=%s",
+		"PlayerAPIOptions": {"Timeout": 1, "Retries": 1, "RetryDelay": 1},
+		"Enforcement": {"Unavailable": "log"}}`
+	if err := ioutil.WriteFile(configpath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewReloader(configpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := reloader.Current().Server("altis1")
+	s, err := NewServer(config, reloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const guid = "0123456789abcdef0123456789abcdef"
+	s.registry.Apply(events.PlayerConnected{ID: 3, Name: "John Doe", IP: "203.0.113.7"})
+	s.registry.Apply(events.PlayerGUIDUnverified{ID: 3, Name: "John Doe", GUID: guid})
+	// admit leaves out the country check after a failed lookup, the
+	// player could not be asked about a bypass
+	gone, failed := s.checkPlayer(3, guid, false)
+	if gone || !failed {
+		t.Fatalf("got gone %v, failed %v", gone, failed)
+	}
+	if line := <-s.kickLog; !strings.Contains(line, "#API #3 John Doe") {
+		t.Errorf("kick log %q", line)
+	}
+}
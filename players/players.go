@@ -0,0 +1,238 @@
+package players
+
+import (
+	"ghosthunter/events"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Player struct {
+	ID        int
+	Name      string
+	GUID      string
+	IP        string
+	Port      int
+	Ping      int
+	Verified  bool
+	Lobby     bool
+	Connected time.Time // session start
+	Updated   time.Time
+
+	BypassCountry bool // exempt from the country restriction by the player api
+	Checked       bool // the join checks have run
+}
+
+// Registry keeps track of the players currently on the server, keyed by
+// their BattlEye slot number. It is safe for concurrent use.
+type Registry struct {
+	players map[int]*Player
+	mutex   *sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		players: make(map[int]*Player),
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// Apply merges a server message event into the registry.
+func (r *Registry) Apply(e events.Event) {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch e := e.(type) {
+	case events.PlayerConnected:
+		// the GUID line may have been applied already, keep what it set
+		p := r.slot(e.ID, e.Name, "", now)
+		p.IP = e.IP
+		p.Port = e.Port
+		p.Updated = now
+	case events.PlayerGUIDUnverified:
+		p := r.slot(e.ID, e.Name, e.GUID, now)
+		p.GUID = e.GUID
+		p.Verified = false
+		p.Updated = now
+	case events.PlayerGUIDVerified:
+		p := r.slot(e.ID, e.Name, e.GUID, now)
+		p.GUID = e.GUID
+		p.Verified = true
+		p.Updated = now
+	case events.PlayerDisconnected:
+		delete(r.players, e.ID)
+	case events.PlayerKicked:
+		delete(r.players, e.ID)
+	case events.FilterKick:
+		delete(r.players, e.ID)
+	case events.PlayerBanned:
+		delete(r.players, e.ID)
+	}
+}
+
+// slot returns the entry of a slot, creating it if the connect line was
+// missed. A different name or GUID means the disconnect of the previous
+// player was missed, nothing of its entry is kept. Callers must hold the
+// write lock.
+func (r *Registry) slot(id int, name string, guid string, now time.Time) *Player {
+	p := r.players[id]
+	if p == nil || p.Name != name || (guid != "" && p.GUID != "" && p.GUID != guid) {
+		p = &Player{ID: id, Name: name, Connected: now}
+		r.players[id] = p
+	}
+	return p
+}
+
+// Snapshot merges the result of a "players" command. Players missing
+// from the list are removed, session start times of known players are
+// kept.
+func (r *Registry) Snapshot(list []Player) {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	seen := make(map[int]bool, len(list))
+	for _, l := range list {
+		seen[l.ID] = true
+		p := r.players[l.ID]
+		if p == nil || p.Name != l.Name || (p.GUID != "" && l.GUID != "" && p.GUID != l.GUID) {
+			p = &Player{ID: l.ID, Connected: now}
+			r.players[l.ID] = p
+		}
+		p.Name = l.Name
+		p.IP = l.IP
+		p.Port = l.Port
+		p.Ping = l.Ping
+		p.Lobby = l.Lobby
+		if l.GUID != "" {
+			p.GUID = l.GUID
+			p.Verified = l.Verified
+		}
+		p.Updated = now
+	}
+	for id := range r.players {
+		if !seen[id] {
+			delete(r.players, id)
+		}
+	}
+}
+
+// Update changes the player in a slot unless it has been taken by another
+// GUID in the meantime.
+func (r *Registry) Update(id int, guid string, f func(p *Player)) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.players[id]
+	if !ok || p.GUID != guid {
+		return false
+	}
+	f(p)
+	return true
+}
+
+func (r *Registry) Get(id int) (Player, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	p, ok := r.players[id]
+	if !ok {
+		return Player{}, false
+	}
+	return *p, true
+}
+
+// ByGUID returns the player with the GUID. Players whose GUID is not
+// known yet never match.
+func (r *Registry) ByGUID(guid string) (Player, bool) {
+	if guid == "" {
+		return Player{}, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, p := range r.players {
+		if p.GUID == guid {
+			return *p, true
+		}
+	}
+	return Player{}, false
+}
+
+// ByName returns the player whose name matches exactly. Chat messages
+// only carry the sender name, so this is how a message maps to a slot.
+func (r *Registry) ByName(name string) (Player, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, p := range r.players {
+		if p.Name == name {
+			return *p, true
+		}
+	}
+	return Player{}, false
+}
+
+// All returns a copy of all players ordered by slot.
+func (r *Registry) All() []Player {
+	r.mutex.RLock()
+	list := make([]Player, 0, len(r.players))
+	for _, p := range r.players {
+		list = append(list, *p)
+	}
+	r.mutex.RUnlock()
+	sort.Sort(bySlot(list))
+	return list
+}
+
+func (r *Registry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.players)
+}
+
+type bySlot []Player
+
+func (s bySlot) Len() int           { return len(s) }
+func (s bySlot) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s bySlot) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var (
+	reParsePlayer = regexp.MustCompile(`^(\d+)[ ]+(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{1,5})[ ]+(-?\d+)[ ]+(?:(\w{32})\(([^)]+)\)|-)[ ]+(.*)$`)
+)
+
+// ParseList parses the reply of the "players" command.
+func ParseList(response string) []Player {
+	var list []Player
+	for _, line := range strings.Split(response, "\n") {
+		m := reParsePlayer.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		p := Player{
+			ID:       atoi(m[1]),
+			IP:       m[2],
+			Port:     atoi(m[3]),
+			Ping:     atoi(m[4]),
+			GUID:     m[5],
+			Verified: m[6] == "OK",
+			Name:     m[7],
+		}
+		if strings.HasSuffix(p.Name, " (Lobby)") {
+			p.Name = strings.TrimSuffix(p.Name, " (Lobby)")
+			p.Lobby = true
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return i
+}
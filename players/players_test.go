@@ -0,0 +1,112 @@
+package players
+
+import (
+	"ghosthunter/events"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyOutOfOrder(t *testing.T) {
+	const guid = "0123456789abcdef0123456789abcdef"
+	r := NewRegistry()
+	r.Apply(events.PlayerGUIDUnverified{ID: 3, Name: "John Doe", GUID: guid})
+	r.Apply(events.PlayerConnected{ID: 3, Name: "John Doe", IP: "203.0.113.7", Port: 2304})
+
+	p, ok := r.Get(3)
+	if !ok {
+		t.Fatal("player missing")
+	}
+	if p.GUID != guid || p.IP != "203.0.113.7" || p.Port != 2304 {
+		t.Errorf("got %+v", p)
+	}
+
+	// a new player in the slot starts over
+	r.Apply(events.PlayerConnected{ID: 3, Name: "Jane Doe", IP: "198.51.100.1", Port: 2304})
+	if p, _ := r.Get(3); p.GUID != "" || p.Name != "Jane Doe" {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestByGUIDUnknown(t *testing.T) {
+	r := NewRegistry()
+	r.Apply(events.PlayerConnected{ID: 3, Name: "John Doe", IP: "203.0.113.7", Port: 2304})
+	if p, ok := r.ByGUID(""); ok {
+		t.Errorf("empty GUID matched %+v", p)
+	}
+}
+
+func TestApplyMissedDisconnect(t *testing.T) {
+	const guid = "0123456789abcdef0123456789abcdef"
+	r := NewRegistry()
+	r.Apply(events.PlayerConnected{ID: 3, Name: "John Doe", IP: "203.0.113.7", Port: 2304})
+	r.Apply(events.PlayerGUIDUnverified{ID: 3, Name: "John Doe", GUID: guid})
+	r.Update(3, guid, func(p *Player) {
+		p.Checked = true
+		p.BypassCountry = true
+	})
+	r.Apply(events.PlayerGUIDVerified{ID: 3, Name: "John Doe", GUID: guid})
+	if p, _ := r.Get(3); !p.Checked || !p.Verified {
+		t.Errorf("verification started over: %+v", p)
+	}
+
+	// someone else with the same name takes the slot
+	const other = "fedcba9876543210fedcba9876543210"
+	r.Apply(events.PlayerGUIDUnverified{ID: 3, Name: "John Doe", GUID: other})
+	if p, _ := r.Get(3); p.GUID != other || p.Checked || p.BypassCountry || p.IP != "" {
+		t.Errorf("got %+v", p)
+	}
+}
+
+// players is a reply to the "players" command as BattlEye sends it.
+const players = `Players on server:
+[#] [IP Address]:[Port] [Ping] [GUID] [Name]
+--------------------------------------------------
+0   203.0.113.7:2304      31   0123456789abcdef0123456789abcdef(OK) John Doe
+1   198.51.100.1:2316     0    fedcba9876543210fedcba9876543210(?)  Jane Doe (Lobby)
+4   192.0.2.9:2304        -1   -  [TAG] Newcomer
+(3 players in total)`
+
+func TestParseList(t *testing.T) {
+	want := []Player{
+		{ID: 0, IP: "203.0.113.7", Port: 2304, Ping: 31, GUID: "0123456789abcdef0123456789abcdef", Verified: true, Name: "John Doe"},
+		{ID: 1, IP: "198.51.100.1", Port: 2316, Ping: 0, GUID: "fedcba9876543210fedcba9876543210", Name: "Jane Doe", Lobby: true},
+		{ID: 4, IP: "192.0.2.9", Port: 2304, Ping: -1, Name: "[TAG] Newcomer"},
+	}
+	if got := ParseList(players); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := ParseList("Players on server:\n[#] [IP Address]:[Port] [Ping] [GUID] [Name]\n--------------------------------------------------\n(0 players in total)"); len(got) != 0 {
+		t.Errorf("empty list parsed as %+v", got)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := NewRegistry()
+	// the disconnects of 0 and 2 were missed, 4 is not known yet
+	r.Apply(events.PlayerConnected{ID: 0, Name: "John Doe", IP: "203.0.113.7", Port: 2304})
+	r.Apply(events.PlayerGUIDUnverified{ID: 0, Name: "John Doe", GUID: "0123456789abcdef0123456789abcdef"})
+	r.Apply(events.PlayerGUIDUnverified{ID: 1, Name: "Jane Doe", GUID: "00000000000000000000000000000001"})
+	r.Apply(events.PlayerConnected{ID: 2, Name: "Gone", IP: "192.0.2.1", Port: 2304})
+	r.Update(0, "0123456789abcdef0123456789abcdef", func(p *Player) { p.Checked = true })
+	r.Update(1, "00000000000000000000000000000001", func(p *Player) { p.Checked = true })
+	before, _ := r.Get(0)
+
+	time.Sleep(time.Millisecond)
+	r.Snapshot(ParseList(players))
+	list := r.All()
+	if len(list) != 3 || list[0].ID != 0 || list[1].ID != 1 || list[2].ID != 4 {
+		t.Fatalf("got %+v", list)
+	}
+	john, jane, newcomer := list[0], list[1], list[2]
+	if !john.Connected.Equal(before.Connected) || !john.Checked || !john.Verified || john.Ping != 31 {
+		t.Errorf("known player %+v", john)
+	}
+	// same name, another GUID: a new session
+	if jane.Checked || jane.GUID != "fedcba9876543210fedcba9876543210" || !jane.Lobby {
+		t.Errorf("new player in a known slot %+v", jane)
+	}
+	if newcomer.GUID != "" || newcomer.Name != "[TAG] Newcomer" || newcomer.Connected.IsZero() {
+		t.Errorf("new player %+v", newcomer)
+	}
+}
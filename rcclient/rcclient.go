@@ -1,8 +1,195 @@
+// Package rcclient is a client of the remotecall admin server.
 package rcclient
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"ghosthunter/remotecall"
-	"log"
+	"net"
+	"sync"
+	"time"
 )
+
+const handshakeTimeout = 10 * time.Second
+
+type Client struct {
+	con     net.Conn
+	udp     bool
+	session uint64 // token of the login, sent with every query
+	acks    chan uint16
+	done    chan struct{} // closed once the connection is gone
+	err     error
+	waiting map[uint16]chan string
+	early   map[uint16]string // results that came before the query was registered
+	mutex   *sync.Mutex
+	query   *sync.Mutex // a single query waits for its ack at a time
+}
+
+// Dial connects to a remotecall server over "tcp" or "udp" and logs in.
+func Dial(ctx context.Context, network string, addr string, password string) (*Client, error) {
+	var d net.Dialer
+	con, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		con:     con,
+		udp:     network == "udp" || network == "udp4" || network == "udp6",
+		acks:    make(chan uint16, 16),
+		done:    make(chan struct{}),
+		waiting: make(map[uint16]chan string),
+		early:   make(map[uint16]string),
+		mutex:   &sync.Mutex{},
+		query:   &sync.Mutex{},
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	con.SetDeadline(deadline)
+	login := remotecall.NewRCClientHandshake()
+	login.Password = password
+	if err := c.write(login); err != nil {
+		con.Close()
+		return nil, err
+	}
+	packet, err := c.read()
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	reply, ok := packet.(*remotecall.RCServerHandshake)
+	if !ok {
+		con.Close()
+		return nil, fmt.Errorf("rcclient: unexpected packet during login")
+	}
+	if reply.Result != 0x01 {
+		con.Close()
+		return nil, fmt.Errorf("rcclient: login failed")
+	}
+	c.session = reply.Session
+	con.SetDeadline(time.Time{})
+	go c.receive()
+	return c, nil
+}
+
+// Query sends a query and waits for its result.
+func (c *Client) Query(ctx context.Context, content string) (string, error) {
+	c.query.Lock()
+	// acks of queries given up on
+	for len(c.acks) > 0 {
+		<-c.acks
+	}
+	packet := remotecall.NewRCClientQuery()
+	packet.Session = c.session
+	packet.Content = content
+	if err := c.write(packet); err != nil {
+		c.query.Unlock()
+		return "", err
+	}
+	var id uint16
+	select {
+	case id = <-c.acks:
+	case <-ctx.Done():
+		c.query.Unlock()
+		return "", ctx.Err()
+	case <-c.done:
+		c.query.Unlock()
+		return "", c.err
+	}
+	result := make(chan string, 1)
+	c.mutex.Lock()
+	if r, ok := c.early[id]; ok {
+		delete(c.early, id)
+		result <- r
+	} else {
+		c.waiting[id] = result
+	}
+	c.mutex.Unlock()
+	c.query.Unlock()
+
+	select {
+	case r := <-result:
+		return r, nil
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.waiting, id)
+		c.mutex.Unlock()
+		return "", ctx.Err()
+	case <-c.done:
+		return "", c.err
+	}
+}
+
+func (c *Client) Close() error {
+	return c.con.Close()
+}
+
+// receive hands acks and results to the waiting queries until the
+// connection fails.
+func (c *Client) receive() {
+	for {
+		packet, err := c.read()
+		if err != nil {
+			c.err = err
+			close(c.done)
+			return
+		}
+		switch p := packet.(type) {
+		case *remotecall.RCServerQuery:
+			select {
+			case c.acks <- p.QueryID:
+			default:
+			}
+		case *remotecall.RCServerQueryResult:
+			c.mutex.Lock()
+			if result, ok := c.waiting[p.QueryID]; ok {
+				delete(c.waiting, p.QueryID)
+				result <- p.Content
+			} else {
+				// mostly results of queries given up on
+				if len(c.early) >= 64 {
+					c.early = make(map[uint16]string)
+				}
+				c.early[p.QueryID] = p.Content
+			}
+			c.mutex.Unlock()
+		case *remotecall.RCServerHandshake:
+			// the server has dropped our udp session
+			c.err = fmt.Errorf("rcclient: logged out by the server")
+			close(c.done)
+			c.con.Close()
+			return
+		}
+	}
+}
+
+func (c *Client) write(p remotecall.RCPacket) error {
+	if !c.udp {
+		return remotecall.WritePacket(c.con, p)
+	}
+	raw, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = c.con.Write(raw)
+	return err
+}
+
+func (c *Client) read() (remotecall.RCPacket, error) {
+	if !c.udp {
+		return remotecall.ReadPacket(c.con)
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.con.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// stray datagrams are skipped
+		if packet, err := remotecall.Decode(buf[:n]); err == nil {
+			return packet, nil
+		}
+	}
+}
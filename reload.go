@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ghosthunter/chatfilter"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Settings is everything that can be swapped at runtime.
+type Settings struct {
+	Config  Config
+	Filters map[string]*chatfilter.Filter // by server name
+}
+
+// Server returns the configuration and chat filter of a server.
+func (s *Settings) Server(name string) (ServerConfig, *chatfilter.Filter) {
+	config, _ := s.Config.Server(name)
+	return config, s.Filters[name]
+}
+
+// Reloader holds the current settings. Readers always see a complete,
+// validated version; a failed reload keeps the previous one.
+type Reloader struct {
+	configpath string
+	value      atomic.Value // *Settings
+	mtimes     map[string]time.Time
+	mutex      *sync.Mutex
+}
+
+func NewReloader(configpath string) (*Reloader, error) {
+	r := &Reloader{
+		configpath: configpath,
+		mtimes:     make(map[string]time.Time),
+		mutex:      &sync.Mutex{},
+	}
+	config, err := loadConfig(configpath)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := loadFilters(config)
+	if err != nil {
+		// run without chat filter until it is fixed
+		log.Println(err)
+	}
+	r.value.Store(settings)
+	r.touch(settings.files(configpath)...)
+	return r, nil
+}
+
+func (r *Reloader) Current() *Settings {
+	return r.value.Load().(*Settings)
+}
+
+// Reload re-reads config and chat filters and swaps them in if all of
+// them are valid.
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	config, err := loadConfig(r.configpath)
+	if err != nil {
+		return fmt.Errorf("reload rejected: %v", err)
+	}
+	settings, err := loadFilters(config)
+	if err != nil {
+		return fmt.Errorf("reload rejected: %v", err)
+	}
+
+	old := r.Current().Config
+	// running servers would fall back to a zero config, dry run included
+	for _, s := range old.ServerList() {
+		if _, ok := config.Server(s.Name); !ok {
+			return fmt.Errorf("reload rejected: server %s is running, removing or renaming it needs a restart", s.Name)
+		}
+	}
+	if len(old.ServerList()) != len(config.ServerList()) || old.BanShare != config.BanShare || old.BanShareFile != config.BanShareFile ||
+		old.PlayerAPIStandIn != config.PlayerAPIStandIn || old.PlayerAPIFile != config.PlayerAPIFile ||
+		old.RemoteCall != config.RemoteCall || old.RemoteCallPassword != config.RemoteCallPassword {
+		log.Printf("reload: added servers, ban share, player api stand-in and remotecall settings only apply after a restart")
+	}
+	for _, s := range config.ServerList() {
+		o, ok := old.Server(s.Name)
+		if ok && o.restartRequired(&s) {
+			log.Printf("reload: connection, poll and ban settings of %s only apply after a restart", s.Name)
+		}
+	}
+
+	r.value.Store(settings)
+	r.touch(settings.files(r.configpath)...)
+	for name, filter := range settings.Filters {
+		log.Printf("reloaded %s: %s (%d rules)", name, filter.Filename, len(filter.Rules))
+	}
+	return nil
+}
+
+// loadFilters loads the chat filter of every server. Servers sharing a
+// filter file share the parsed filter. On error the returned settings
+// lack the broken filters.
+func loadFilters(config *Config) (*Settings, error) {
+	settings := &Settings{Config: *config, Filters: make(map[string]*chatfilter.Filter)}
+	type key struct {
+		filename string
+		options  chatfilter.Options
+	}
+	loaded := make(map[key]*chatfilter.Filter)
+	var err error
+	for _, s := range config.ServerList() {
+		k := key{s.ChatFilter, chatfilter.Options{LegacyReasons: s.ChatFilterReasons}}
+		filter, ok := loaded[k]
+		if !ok {
+			var e error
+			filter, e = chatfilter.Load(k.filename, k.options)
+			if e != nil {
+				err = e
+				continue
+			}
+			loaded[k] = filter
+		}
+		settings.Filters[s.Name] = filter
+	}
+	return settings, err
+}
+
+// files returns the files a reload depends on.
+func (s *Settings) files(configpath string) []string {
+	files := []string{configpath}
+	for _, c := range s.Config.ServerList() {
+		files = append(files, c.ChatFilter)
+	}
+	return files
+}
+
+// Watch reloads on SIGHUP and whenever config or chat filter change on
+// disk.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, errors chan error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				errors <- err
+			}
+		case <-ticker.C:
+			if r.changed() {
+				if err := r.Reload(); err != nil {
+					errors <- err
+				}
+			}
+		}
+	}
+}
+
+// changed reports whether a watched file has been modified since the
+// last load attempt.
+func (r *Reloader) changed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := false
+	for name, mtime := range r.mtimes {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(mtime) {
+			// do not retry an invalid file until it changes again
+			r.mtimes[name] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// touch remembers the modification times of the loaded files.
+func (r *Reloader) touch(names ...string) {
+	r.mtimes = make(map[string]time.Time, len(names))
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err == nil {
+			r.mtimes[name] = info.ModTime()
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"ghosthunter/remotecall"
+	"log"
+	"strings"
+)
+
+// remoteQuery answers remotecall queries. "[@name] #command" runs a
+// console command and returns what it prints, anything else is sent to
+// the server as a BattlEye command and returns its reply.
+func remoteQuery(servers []*Server) remotecall.Handler {
+	return func(ctx context.Context, query string) (string, error) {
+		target, query, err := pick(servers, strings.TrimSpace(query))
+		if err != nil {
+			return "", err
+		}
+		query = strings.TrimSpace(query)
+		if query == "" || query == "#" {
+			return "", fmt.Errorf("empty query")
+		}
+		target.log.Printf("remote query (%s)", query)
+		if strings.HasPrefix(query, "#") {
+			var out bytes.Buffer
+			err := target.Command(query[1:], log.New(&out, "", 0))
+			return out.String(), err
+		}
+		return target.client.Send(ctx, query)
+	}
+}
@@ -0,0 +1,77 @@
+package remotecall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxPacket is the largest packet accepted over tcp. Over udp a packet is
+// bounded by the datagram size.
+const MaxPacket = 1024 * 1024
+
+// Decode checks magic bytes and type of a packet and returns it as
+// *RCClientHandshake, *RCServerHandshake, *RCClientQuery, *RCServerQuery
+// or *RCServerQueryResult.
+func Decode(rawBytes []byte) (RCPacket, error) {
+	if len(rawBytes) < 5 {
+		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", len(rawBytes))
+	}
+	var packet RCPacket
+	switch rawBytes[4] {
+	case 0x00:
+		packet = NewRCClientHandshake()
+	case 0x01:
+		packet = NewRCServerHandshake()
+	case 0x10:
+		packet = NewRCClientQuery()
+	case 0x11:
+		packet = NewRCServerQuery()
+	case 0x12:
+		packet = NewRCServerQueryResult()
+	default:
+		return nil, fmt.Errorf("invalid packet: packet type (0x%x)", rawBytes[4])
+	}
+	if err := packet.Unmarshal(rawBytes); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// WritePacket writes a packet to a stream. Over tcp every packet is
+// preceded by its length as a little endian uint32.
+func WritePacket(w io.Writer, packet RCPacket) error {
+	raw, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	if len(raw) > MaxPacket {
+		return fmt.Errorf("invalid packet: packet length too large (%d)", len(raw))
+	}
+	frame := make([]byte, 4, 4+len(raw))
+	binary.LittleEndian.PutUint32(frame, uint32(len(raw)))
+	_, err = w.Write(append(frame, raw...))
+	return err
+}
+
+// ReadPacket reads a packet written by WritePacket.
+func ReadPacket(r io.Reader) (RCPacket, error) {
+	return readPacket(r, MaxPacket)
+}
+
+// readPacket reads a packet of at most max bytes.
+func readPacket(r io.Reader, max uint32) (RCPacket, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(length[:])
+	if n > max {
+		return nil, fmt.Errorf("invalid packet: packet length too large (%d)", n)
+	}
+	raw := make([]byte, n)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return Decode(raw)
+}
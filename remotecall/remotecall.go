@@ -26,7 +26,7 @@ func (n *RCHeader) Unmarshal(rawBytes []byte) error {
 	if length != 4 {
 		return fmt.Errorf("invalid packet header: packet length mismatch (%d)", length)
 	}
-	n.MagicBytes = rawBytes[:2]
+	n.MagicBytes = append([]byte(nil), rawBytes[:2]...)
 	if !bytes.Equal(n.MagicBytes, []byte("RC")) {
 		return fmt.Errorf("invalid packet header: magic bytes (%s)", n.MagicBytes)
 	}
@@ -53,6 +53,21 @@ func (b *RCHeader) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// unmarshalPacket decodes the header of a packet of the given type that
+// is at least min bytes long.
+func unmarshalPacket(rawBytes []byte, header *RCHeader, packetType byte, min int) error {
+	if len(rawBytes) < min {
+		return fmt.Errorf("invalid packet: packet length too small (%d)", len(rawBytes))
+	}
+	if err := header.Unmarshal(rawBytes[:4]); err != nil {
+		return err
+	}
+	if rawBytes[4] != packetType {
+		return fmt.Errorf("invalid packet: packet type (0x%x)", rawBytes[4])
+	}
+	return nil
+}
+
 type RCClientHandshake struct {
 	Header     RCHeader
 	PacketType byte
@@ -68,7 +83,7 @@ func NewRCClientHandshake() *RCClientHandshake {
 }
 
 func (b *RCClientHandshake) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:4])
+	err := unmarshalPacket(rawBytes, &b.Header, 0x00, 5)
 	if err != nil {
 		return err
 	}
@@ -90,16 +105,19 @@ func (b *RCClientHandshake) Marshal() ([]byte, error) {
 	length += 1
 	n, _ = buf.WriteString(b.Password)
 	length += n
-	if length != (4 + len(b.Password)) {
+	if length != (5 + len(b.Password)) {
 		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", length)
 	}
 	return buf.Bytes(), nil
 }
 
+// RCServerHandshake answers a login. Result 0x01 means success and
+// Session is the token every query of the client has to carry.
 type RCServerHandshake struct {
 	Header     RCHeader
 	PacketType byte
 	Result     byte
+	Session    uint64
 }
 
 func NewRCServerHandshake() *RCServerHandshake {
@@ -107,16 +125,21 @@ func NewRCServerHandshake() *RCServerHandshake {
 	packet.Header = *NewRCHeader()
 	packet.PacketType = 0x01
 	packet.Result = 0x00
+	packet.Session = 0
 	return &packet
 }
 
 func (b *RCServerHandshake) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:4])
+	if len(rawBytes) != 14 {
+		return fmt.Errorf("invalid packet: packet length mismatch (%d)", len(rawBytes))
+	}
+	err := unmarshalPacket(rawBytes, &b.Header, 0x01, 14)
 	if err != nil {
 		return err
 	}
 	b.PacketType = rawBytes[4:5][0]
 	b.Result = rawBytes[5:6][0]
+	b.Session = binary.LittleEndian.Uint64(rawBytes[6:14])
 	return nil
 }
 
@@ -133,7 +156,11 @@ func (b *RCServerHandshake) Marshal() ([]byte, error) {
 	length += 1
 	buf.WriteByte(b.Result)
 	length += 1
-	if length != 6 {
+	tmp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tmp, b.Session)
+	n, _ = buf.Write(tmp)
+	length += n
+	if length != 14 {
 		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", length)
 	}
 	return buf.Bytes(), nil
@@ -142,6 +169,7 @@ func (b *RCServerHandshake) Marshal() ([]byte, error) {
 type RCClientQuery struct {
 	Header     RCHeader
 	PacketType byte
+	Session    uint64 // from the server handshake
 	Content    string
 }
 
@@ -149,17 +177,19 @@ func NewRCClientQuery() *RCClientQuery {
 	var packet RCClientQuery
 	packet.Header = *NewRCHeader()
 	packet.PacketType = 0x10
+	packet.Session = 0
 	packet.Content = ""
 	return &packet
 }
 
 func (b *RCClientQuery) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:4])
+	err := unmarshalPacket(rawBytes, &b.Header, 0x10, 13)
 	if err != nil {
 		return err
 	}
 	b.PacketType = rawBytes[4:5][0]
-	b.Content = string(rawBytes[5:])
+	b.Session = binary.LittleEndian.Uint64(rawBytes[5:13])
+	b.Content = string(rawBytes[13:])
 	return nil
 }
 
@@ -174,9 +204,13 @@ func (b *RCClientQuery) Marshal() ([]byte, error) {
 	length += n
 	buf.WriteByte(b.PacketType)
 	length += 1
+	tmp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tmp, b.Session)
+	n, _ = buf.Write(tmp)
+	length += n
 	n, _ = buf.WriteString(b.Content)
 	length += n
-	if length != (4 + len(b.Content)) {
+	if length != (13 + len(b.Content)) {
 		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", length)
 	}
 	return buf.Bytes(), nil
@@ -197,7 +231,10 @@ func NewRCServerQuery() *RCServerQuery {
 }
 
 func (b *RCServerQuery) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:4])
+	if len(rawBytes) != 7 {
+		return fmt.Errorf("invalid packet: packet length mismatch (%d)", len(rawBytes))
+	}
+	err := unmarshalPacket(rawBytes, &b.Header, 0x11, 7)
 	if err != nil {
 		return err
 	}
@@ -219,6 +256,7 @@ func (b *RCServerQuery) Marshal() ([]byte, error) {
 	length += 1
 	tmp := make([]byte, 2)
 	binary.LittleEndian.PutUint16(tmp, b.QueryID)
+	n, _ = buf.Write(tmp)
 	length += n
 	if length != 7 {
 		return nil, fmt.Errorf("invalid packet: packet length too small (%d)", length)
@@ -243,7 +281,7 @@ func NewRCServerQueryResult() *RCServerQueryResult {
 }
 
 func (b *RCServerQueryResult) Unmarshal(rawBytes []byte) error {
-	err := b.Header.Unmarshal(rawBytes[:4])
+	err := unmarshalPacket(rawBytes, &b.Header, 0x12, 7)
 	if err != nil {
 		return err
 	}
@@ -266,6 +304,7 @@ func (b *RCServerQueryResult) Marshal() ([]byte, error) {
 	length += 1
 	tmp := make([]byte, 2)
 	binary.LittleEndian.PutUint16(tmp, b.QueryID)
+	n, _ = buf.Write(tmp)
 	length += n
 	n, _ = buf.WriteString(b.Content)
 	length += n
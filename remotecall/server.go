@@ -0,0 +1,403 @@
+package remotecall
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueryTimeout     = 30 * time.Second
+	DefaultIdleTimeout      = 10 * time.Minute
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultMaxConns         = 32
+
+	loginDelay   = time.Second // answer wrong passwords late
+	maxLogins    = 5           // login attempts per address and loginWindow
+	maxUDPLogins = 30          // failed udp logins of all addresses per loginWindow
+	loginWindow  = time.Minute
+	maxHandshake = 4096 // bytes of a tcp packet before login
+	maxDatagram  = 65507
+	maxLimited   = 1024 // addresses remembered before old ones are swept
+)
+
+// Handler answers a query, an error is sent back as the result.
+type Handler func(ctx context.Context, query string) (string, error)
+
+type Config struct {
+	Password         string
+	QueryTimeout     time.Duration // handler deadline
+	IdleTimeout      time.Duration // drop clients that stay silent
+	HandshakeTimeout time.Duration // drop tcp clients that do not log in
+	MaxConns         int           // tcp connections, logged in or not
+	Logger           *log.Logger
+}
+
+// Server authenticates RC clients with a password and answers their
+// queries. Every query is acknowledged with its QueryID right away, the
+// result follows once the handler returns. Over tcp packets are framed
+// by WritePacket, over udp every datagram is one packet and nothing is
+// resent. A login hands out a random session token that every query has
+// to carry, so spoofed udp queries are ignored.
+//
+// Each tcp address gets a few login attempts per minute. Udp source
+// addresses can be forged, so udp attempts never count towards that
+// lockout: they are limited per address and port, and failed udp logins
+// of everyone together are capped. Forged packets can at most hold up
+// udp logins for a minute, tcp logins keep working.
+type Server struct {
+	cfg       Config
+	handler   Handler
+	log       *log.Logger
+	logins    *limiter      // tcp, by ip
+	udpLogins *limiter      // udp, by ip and port
+	udpFailed *limiter      // udp, failures of all addresses
+	conns     chan struct{} // one per open tcp connection
+}
+
+// udpSession is a logged in udp client.
+type udpSession struct {
+	seen    time.Time
+	token   uint64
+	queryID uint16
+}
+
+// limiter counts login attempts per address.
+type limiter struct {
+	max      int // attempts per loginWindow
+	mutex    *sync.Mutex
+	attempts map[string]*attempts
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max, mutex: &sync.Mutex{}, attempts: make(map[string]*attempts)}
+}
+
+type attempts struct {
+	count int
+	since time.Time
+}
+
+func NewServer(cfg Config, h Handler) *Server {
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = DefaultQueryTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultMaxConns
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	return &Server{
+		cfg:       cfg,
+		handler:   h,
+		log:       logger,
+		logins:    newLimiter(maxLogins),
+		udpLogins: newLimiter(maxLogins),
+		udpFailed: newLimiter(maxUDPLogins),
+		conns:     make(chan struct{}, cfg.MaxConns),
+	}
+}
+
+// ListenAndServe serves tcp and udp clients on addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	con, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	errors := make(chan error, 2)
+	go func() {
+		errors <- s.ServeTCP(ctx, l)
+	}()
+	go func() {
+		errors <- s.ServeUDP(ctx, con)
+	}()
+	err = <-errors
+	l.Close()
+	con.Close()
+	if err2 := <-errors; err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ServeTCP accepts connections on l until ctx is done.
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		con, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case s.conns <- struct{}{}:
+		default:
+			s.log.Printf("%s refused, too many connections", con.RemoteAddr())
+			con.Close()
+			continue
+		}
+		go func() {
+			s.serveConn(ctx, con)
+			<-s.conns
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, con net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+	remote := con.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(remote)
+
+	// small and quick until logged in
+	con.SetReadDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
+	packet, err := readPacket(con, maxHandshake)
+	if err != nil {
+		return
+	}
+	login, ok := packet.(*RCClientHandshake)
+	if !ok {
+		s.log.Printf("%s did not log in", remote)
+		return
+	}
+	reply := NewRCServerHandshake()
+	if !s.logins.allow(host, time.Now()) {
+		s.log.Printf("%s has too many login attempts", remote)
+		time.Sleep(loginDelay)
+		WritePacket(con, reply)
+		return
+	}
+	if !s.authenticate(login.Password) {
+		s.log.Printf("%s used a wrong password", remote)
+		time.Sleep(loginDelay)
+		WritePacket(con, reply)
+		return
+	}
+	s.logins.reset(host)
+	reply.Result = 0x01
+	reply.Session = newSession()
+	if WritePacket(con, reply) != nil {
+		return
+	}
+	s.log.Printf("%s logged in", remote)
+	session := reply.Session
+
+	mutex := &sync.Mutex{}
+	write := func(p RCPacket) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err := WritePacket(con, p); err != nil {
+			cancel()
+		}
+	}
+	var queryID uint16
+	for {
+		con.SetReadDeadline(time.Now().Add(s.cfg.IdleTimeout))
+		packet, err := ReadPacket(con)
+		if err != nil {
+			s.log.Printf("%s disconnected (%v)", remote, err)
+			return
+		}
+		query, ok := packet.(*RCClientQuery)
+		if !ok {
+			continue
+		}
+		if query.Session != session {
+			s.log.Printf("%s sent a query of another session", remote)
+			return
+		}
+		queryID++
+		id := queryID
+		ack := NewRCServerQuery()
+		ack.QueryID = id
+		write(ack)
+		go func() {
+			write(s.answer(ctx, id, query.Content, MaxPacket))
+		}()
+	}
+}
+
+// ServeUDP serves clients on con until ctx is done.
+func (s *Server) ServeUDP(ctx context.Context, con *net.UDPConn) error {
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+	sessions := make(map[string]*udpSession)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := con.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		now := time.Now()
+		for key, session := range sessions {
+			if now.Sub(session.seen) > s.cfg.IdleTimeout {
+				delete(sessions, key)
+			}
+		}
+		packet, err := Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+		key := addr.String()
+		switch p := packet.(type) {
+		case *RCClientHandshake:
+			reply := NewRCServerHandshake()
+			if !s.udpLogins.allow(key, now) || s.udpFailed.blocked("", now) {
+				s.log.Printf("%s has too many login attempts", key)
+				time.AfterFunc(loginDelay, func() {
+					s.writeUDP(con, addr, reply)
+				})
+				continue
+			}
+			if !s.authenticate(p.Password) {
+				s.log.Printf("%s used a wrong password", key)
+				s.udpFailed.allow("", now)
+				time.AfterFunc(loginDelay, func() {
+					s.writeUDP(con, addr, reply)
+				})
+				continue
+			}
+			s.udpLogins.reset(key)
+			sessions[key] = &udpSession{seen: now, token: newSession()}
+			reply.Result = 0x01
+			reply.Session = sessions[key].token
+			s.writeUDP(con, addr, reply)
+			s.log.Printf("%s logged in", key)
+		case *RCClientQuery:
+			session := sessions[key]
+			if session == nil || session.token != p.Session {
+				// tell the client to log in again
+				s.writeUDP(con, addr, NewRCServerHandshake())
+				continue
+			}
+			session.seen = now
+			session.queryID++
+			ack := NewRCServerQuery()
+			ack.QueryID = session.queryID
+			s.writeUDP(con, addr, ack)
+			id, content := session.queryID, p.Content
+			go func() {
+				s.writeUDP(con, addr, s.answer(ctx, id, content, maxDatagram))
+			}()
+		}
+	}
+}
+
+func (s *Server) writeUDP(con *net.UDPConn, addr *net.UDPAddr, p RCPacket) {
+	raw, err := p.Marshal()
+	if err != nil {
+		s.log.Println(err)
+		return
+	}
+	con.WriteToUDP(raw, addr)
+}
+
+// answer runs the handler and wraps its result into a packet of at most
+// max bytes.
+func (s *Server) answer(ctx context.Context, id uint16, query string, max int) *RCServerQueryResult {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+	result, err := s.handler(ctx, query)
+	if err != nil {
+		result = fmt.Sprintf("error: %v", err)
+	}
+	if len(result) > max-7 {
+		result = result[:max-7]
+	}
+	packet := NewRCServerQueryResult()
+	packet.QueryID = id
+	packet.Content = result
+	return packet
+}
+
+func (s *Server) authenticate(password string) bool {
+	return s.cfg.Password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password)) == 1
+}
+
+// newSession returns a random session token.
+func newSession() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// allow counts a login attempt of host and reports whether it is within
+// the limit.
+func (l *limiter) allow(host string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.attempts) >= maxLimited {
+		for h, a := range l.attempts {
+			if now.Sub(a.since) >= loginWindow {
+				delete(l.attempts, h)
+			}
+		}
+	}
+	a := l.attempts[host]
+	if a == nil || now.Sub(a.since) >= loginWindow {
+		a = &attempts{since: now}
+		l.attempts[host] = a
+	}
+	if a.count >= l.max {
+		return false
+	}
+	a.count++
+	return true
+}
+
+// blocked reports whether host has used up its attempts without counting
+// another one.
+func (l *limiter) blocked(host string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	a := l.attempts[host]
+	return a != nil && now.Sub(a.since) < loginWindow && a.count >= l.max
+}
+
+// reset forgets the attempts of host after it has logged in.
+func (l *limiter) reset(host string) {
+	l.mutex.Lock()
+	delete(l.attempts, host)
+	l.mutex.Unlock()
+}
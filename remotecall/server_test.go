@@ -0,0 +1,239 @@
+package remotecall
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func echo(ctx context.Context, query string) (string, error) {
+	return "echo " + query, nil
+}
+
+// exchange sends p over udp and returns the next packet that arrives.
+func exchange(t *testing.T, con net.Conn, p RCPacket) RCPacket {
+	t.Helper()
+	raw, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := con.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	con.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, maxDatagram)
+	n, err := con.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestUDPSession(t *testing.T) {
+	con, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewServer(Config{Password: "secret"}, echo).ServeUDP(ctx, con)
+
+	client, err := net.Dial("udp", con.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	login := NewRCClientHandshake()
+	login.Password = "secret"
+	reply, ok := exchange(t, client, login).(*RCServerHandshake)
+	if !ok || reply.Result != 0x01 {
+		t.Fatalf("login failed: %#v", reply)
+	}
+
+	// a query without the session token is not answered
+	query := NewRCClientQuery()
+	query.Session = reply.Session + 1
+	query.Content = "players"
+	if p, ok := exchange(t, client, query).(*RCServerHandshake); !ok || p.Result != 0x00 {
+		t.Fatalf("query of another session got %#v", p)
+	}
+
+	query.Session = reply.Session
+	ack, ok := exchange(t, client, query).(*RCServerQuery)
+	if !ok {
+		t.Fatalf("got %#v, want an ack", ack)
+	}
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, maxDatagram)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := result.(*RCServerQueryResult); !ok || r.QueryID != ack.QueryID || r.Content != "echo players" {
+		t.Errorf("got %#v", result)
+	}
+}
+
+func TestTCPLoginLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewServer(Config{Password: "secret"}, echo).ServeTCP(ctx, l)
+
+	login := func(password string) byte {
+		con, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer con.Close()
+		p := NewRCClientHandshake()
+		p.Password = password
+		if err := WritePacket(con, p); err != nil {
+			t.Error(err)
+			return 0
+		}
+		con.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := ReadPacket(con)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		return reply.(*RCServerHandshake).Result
+	}
+
+	// guesses in parallel count as well
+	var wg sync.WaitGroup
+	for i := 0; i < maxLogins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			login("wrong")
+		}()
+	}
+	wg.Wait()
+	if result := login("secret"); result != 0x00 {
+		t.Error("logged in after too many attempts")
+	}
+}
+
+func TestUDPLoginsDoNotLockOutTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	con, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(Config{Password: "secret"}, echo)
+	go server.ServeTCP(ctx, l)
+	go server.ServeUDP(ctx, con)
+
+	// anyone can send these with the address of an admin
+	spoofed, err := net.Dial("udp", con.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofed.Close()
+	wrong := NewRCClientHandshake()
+	wrong.Password = "wrong"
+	raw, err := wrong.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*maxLogins; i++ {
+		if _, err := spoofed.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	login := NewRCClientHandshake()
+	login.Password = "secret"
+	client, err := net.Dial("udp", con.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if reply, ok := exchange(t, client, login).(*RCServerHandshake); !ok || reply.Result != 0x01 {
+		t.Errorf("udp login from another port failed: %#v", reply)
+	}
+
+	tcp, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if err := WritePacket(tcp, login); err != nil {
+		t.Fatal(err)
+	}
+	tcp.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply, err := ReadPacket(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.(*RCServerHandshake).Result != 0x01 {
+		t.Error("tcp login locked out by udp attempts")
+	}
+}
+
+func TestTCPHandshakeLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewServer(Config{Password: "secret", HandshakeTimeout: 200 * time.Millisecond, MaxConns: 2}, echo).ServeTCP(ctx, l)
+
+	closed := func(con net.Conn, within time.Duration) bool {
+		con.SetReadDeadline(time.Now().Add(within))
+		_, err := con.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false
+		}
+		return err != nil
+	}
+	dial := func() net.Conn {
+		con, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { con.Close() })
+		return con
+	}
+
+	// a large frame before login
+	large := dial()
+	large.Write([]byte{0xff, 0xff, 0x0f, 0x00})
+	if !closed(large, 3*time.Second) {
+		t.Error("large handshake frame accepted")
+	}
+
+	// silent clients fill the slots until the handshake deadline
+	silent := []net.Conn{dial(), dial()}
+	time.Sleep(50 * time.Millisecond)
+	if !closed(dial(), time.Second) {
+		t.Error("connection beyond MaxConns accepted")
+	}
+	for _, con := range silent {
+		if !closed(con, 3*time.Second) {
+			t.Error("silent client kept past the handshake deadline")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ghosthunter/battleye"
+	"ghosthunter/udp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// replay feeds a capture through the handlers of the named server. Nothing
+// is sent to any server and all kicks and bans are simulated; the logs go
+// to the replay directory inside LogDir.
+func replay(reloader *Reloader, name string, filename string) error {
+	config := reloader.Current().Config
+	servers := config.ServerList()
+	if name == "" {
+		if len(servers) != 1 {
+			return fmt.Errorf("several servers configured, use -server name")
+		}
+		name = servers[0].Name
+	}
+	cfg, ok := config.Server(name)
+	if !ok {
+		return fmt.Errorf("unknown server (%s)", name)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	records, err := udp.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	s, err := NewServer(cfg, reloader)
+	if err != nil {
+		return err
+	}
+	return s.Replay(records)
+}
+
+// Replay runs the message and command handlers on the packets the server
+// has sent in records and returns once all of them are handled. Commands
+// the client has sent only tell which reply sequences start over.
+func (s *Server) Replay(records []udp.Record) error {
+	config, _ := s.settings()
+	logs, err := openLogs(filepath.Join(config.LogDir, "replay"))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	s.replay = true
+	// the player api answers for today, not for the capture
+	s.api = nil
+	client := make(chan struct{})
+	go s.writeLogs(logs, client)
+	// a single handler keeps the messages in order
+	s.spawn(s.handleMessages)
+	s.spawn(s.handleCommands)
+
+	replies := udp.NewReassembler(time.Duration(config.ReassemblyTimeout) * time.Second)
+	var messages udp.Window
+	var last time.Time
+	for _, r := range records {
+		// replies the capture never completes fail in capture time
+		for _, reply := range replies.Expire(r.Time) {
+			s.client.CmdIn <- reply
+		}
+		last = r.Time
+		decoded, err := battleye.DecodeFrom(r.Direction, r.Packet)
+		if err != nil {
+			s.errors <- fmt.Errorf("replay %s: %v", r.Time.Format(time.RFC3339Nano), err)
+			continue
+		}
+		switch p := decoded.(type) {
+		case *battleye.BEClientCommand:
+			// the sequence is reused by a new command
+			replies.Forget(p.Sequence)
+		case *battleye.BEServerLogin:
+			// a new connection starts counting again, what is left of
+			// the previous one will never complete
+			for _, reply := range replies.Expire(r.Time.Add(replies.Window)) {
+				s.client.CmdIn <- reply
+			}
+			messages = udp.Window{}
+			replies = udp.NewReassembler(replies.Window)
+		case *battleye.BEServerMessage:
+			if !messages.Add(p.Sequence) {
+				s.client.MsgIn <- *p
+			}
+		case *battleye.BEServerCommand:
+			if reply, ok := replies.AddAt(*p, r.Time); ok {
+				s.client.CmdIn <- *reply
+			}
+		}
+	}
+	// the capture ends before the rest of these replies
+	for _, reply := range replies.Expire(last.Add(replies.Window)) {
+		s.client.CmdIn <- reply
+	}
+
+	// the handlers finish the packet they hold before they see cancel
+	for len(s.client.MsgIn) > 0 || len(s.client.CmdIn) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	close(client)
+	<-s.Done()
+	return nil
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ghosthunter/api"
+	"ghosthunter/bans"
+	"ghosthunter/battleye"
+	"ghosthunter/chatfilter"
+	"ghosthunter/events"
+	"ghosthunter/geo"
+	"ghosthunter/players"
+	"ghosthunter/udp"
+	"github.com/daviddengcn/go-colortext"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server supervises one BattlEye RCon connection together with its
+// player registry, ban database and log files.
+type Server struct {
+	Name     string
+	client   *udp.UDPClient
+	registry *players.Registry
+	store    *bans.Store
+	api      *api.Client // nil without a player api
+	geo      *geo.DB     // nil without a GeoIP database
+	asn      *geo.ASNDB  // nil without a GeoIP ASN database
+	blocked  *geo.Blocklist
+	reloader *Reloader
+	log      *log.Logger
+
+	kickLog, banLog, chatLog chan string
+	errors                   chan error
+
+	ctx     context.Context
+	replay  bool            // fed from a capture, never act on anything
+	workers *sync.WaitGroup // every goroutine that may write to the logs
+	stopped chan struct{}   // closed once the log files are flushed
+}
+
+func NewServer(cfg ServerConfig, reloader *Reloader) (*Server, error) {
+	store, err := bans.Open(cfg.BanDatabase)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Name:     cfg.Name,
+		client:   udp.NewUDPClient(&cfg.Config),
+		registry: players.NewRegistry(),
+		store:    store,
+		reloader: reloader,
+		log:      log.New(os.Stderr, "["+cfg.Name+"] ", log.LstdFlags),
+		kickLog:  make(chan string, 5),
+		banLog:   make(chan string, 5),
+		chatLog:  make(chan string, 5),
+		errors:   make(chan error, 5),
+		ctx:      context.Background(),
+		workers:  &sync.WaitGroup{},
+		stopped:  make(chan struct{}),
+	}
+	if cfg.PlayerAPI != "" {
+		s.api = api.NewClient(cfg.PlayerAPI, cfg.PlayerAPIOptions)
+	}
+	if cfg.GeoIP != "" {
+		if s.geo, err = geo.Open(cfg.GeoIP); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GeoIPASN != "" {
+		if s.asn, err = geo.OpenASN(cfg.GeoIPASN); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.VPN.Blocklists) > 0 {
+		if s.blocked, err = geo.LoadBlocklist(cfg.VPN.Blocklists...); err != nil {
+			return nil, err
+		}
+		ranges, asns := s.blocked.Len()
+		s.log.Printf("blocklists: %d ranges, %d AS numbers", ranges, asns)
+	}
+	return s, nil
+}
+
+// settings returns the current configuration and chat filter.
+func (s *Server) settings() (ServerConfig, *chatfilter.Filter) {
+	return s.reloader.Current().Server(s.Name)
+}
+
+// Start runs the server until ctx is done. Done reports when everything
+// has shut down.
+func (s *Server) Start(ctx context.Context) error {
+	config, _ := s.settings()
+
+	logs, err := openLogs(config.LogDir)
+	if err != nil {
+		return err
+	}
+	s.ctx = ctx
+	client := make(chan struct{})
+	go s.writeLogs(logs, client)
+
+	if config.Capture {
+		if err := s.client.StartCapture(config.capture()); err != nil {
+			return err
+		}
+	}
+	go func() {
+		s.client.Run(ctx)
+		if err := s.client.StopCapture(); err != nil {
+			s.errors <- err
+		}
+		close(client)
+	}()
+
+	// a single handler applies the events of a slot in order, the slow
+	// join checks run on their own
+	s.spawn(s.handleMessages)
+	s.spawn(s.handleCommands)
+	if config.PlayerPoll > 0 {
+		s.spawn(func() {
+			s.pollPlayers(time.Duration(config.PlayerPoll) * time.Second)
+		})
+	}
+
+	s.spawn(func() {
+		s.expireBans(time.Minute)
+	})
+	if config.BanFederation > 0 && len(config.BanSources) > 0 {
+		s.spawn(func() {
+			s.federate(config, time.Duration(config.BanFederation)*time.Second)
+		})
+	}
+	if config.BanSync > 0 {
+		s.spawn(func() {
+			ticker := time.NewTicker(time.Duration(config.BanSync) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.syncBans()
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// Done is closed once the server has stopped and its logs are flushed.
+func (s *Server) Done() <-chan struct{} {
+	return s.stopped
+}
+
+func (s *Server) spawn(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
+}
+
+type logFiles struct {
+	err, kick, ban, chat *os.File
+}
+
+func openLogs(dir string) (*logFiles, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	open := func(name string) (*os.File, error) {
+		return os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	}
+	var files logFiles
+	var err error
+	if files.err, err = open("error.log"); err != nil {
+		return nil, err
+	}
+	if files.kick, err = open("kick.log"); err != nil {
+		return nil, err
+	}
+	if files.ban, err = open("ban.log"); err != nil {
+		return nil, err
+	}
+	if files.chat, err = open("chat.log"); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+func (f *logFiles) close() {
+	for _, file := range []*os.File{f.err, f.kick, f.ban, f.chat} {
+		file.Sync()
+		file.Close()
+	}
+}
+
+// writeLogs writes to the log files until the client and every worker
+// have stopped, then flushes and closes them.
+func (s *Server) writeLogs(files *logFiles, client chan struct{}) {
+	defer close(s.stopped)
+	defer files.close()
+
+	states := s.client.Subscribe()
+	defer s.client.Unsubscribe(states)
+	workers := make(chan struct{})
+	go func() {
+		<-client
+		s.workers.Wait()
+		close(workers)
+	}()
+	for {
+		select {
+		case <-workers:
+			s.flushLogs(files)
+			return
+		case c := <-states:
+			s.log.Printf("connection %s -> %s", c.From, c.To)
+		case e := <-s.errors:
+			files.err.WriteString(time.Now().String() + " " + e.Error() + "\n")
+			ct.ChangeColor(ct.Cyan, true, ct.Black, false)
+			s.log.Println(e)
+			ct.ResetColor()
+		case e := <-s.client.Err:
+			files.err.WriteString(time.Now().String() + " " + e.Error() + "\n")
+			ct.ChangeColor(ct.Cyan, true, ct.Black, false)
+			s.log.Println(e)
+			ct.ResetColor()
+		case k := <-s.kickLog:
+			files.kick.WriteString(time.Now().String() + " " + k + "\n")
+			ct.ChangeColor(ct.Red, true, ct.Black, false)
+			s.log.Println(k)
+			ct.ResetColor()
+		case c := <-s.chatLog:
+			files.chat.WriteString(time.Now().String() + " " + c + "\n")
+			//s.log.Println(c)
+		case b := <-s.banLog:
+			files.ban.WriteString(time.Now().String() + " " + b + "\n")
+			ct.ChangeColor(ct.Red, true, ct.Black, false)
+			s.log.Println(b)
+			ct.ResetColor()
+		}
+	}
+}
+
+// flushLogs writes whatever is still buffered once nobody sends anymore.
+func (s *Server) flushLogs(files *logFiles) {
+	for {
+		select {
+		case e := <-s.errors:
+			files.err.WriteString(time.Now().String() + " " + e.Error() + "\n")
+			s.log.Println(e)
+		case k := <-s.kickLog:
+			files.kick.WriteString(time.Now().String() + " " + k + "\n")
+			s.log.Println(k)
+		case c := <-s.chatLog:
+			files.chat.WriteString(time.Now().String() + " " + c + "\n")
+		case b := <-s.banLog:
+			files.ban.WriteString(time.Now().String() + " " + b + "\n")
+			s.log.Println(b)
+		default:
+			return
+		}
+	}
+}
+
+// Command runs a console command against this server, output goes to
+// out.
+func (s *Server) Command(line string, out *log.Logger) error {
+	rawstr := strings.Fields(line)
+	if len(rawstr) == 0 {
+		return nil
+	}
+	switch rawstr[0] {
+	case "kick":
+		if len(rawstr) == 2 {
+			return s.send(fmt.Sprintf("kick %s", rawstr[1]))
+		} else if len(rawstr) >= 3 {
+			return s.send(fmt.Sprintf("kick %s %s", rawstr[1], strings.Join(rawstr[2:], " ")))
+		}
+	case "ping":
+		return s.send("maxping")
+	case "pl", "players":
+		return s.send("players")
+	case "status":
+		status := s.client.Status()
+		line := fmt.Sprintf("%s since %s, %d failed attempts", status.State, status.Since.Format(time.Stamp), status.Attempts)
+		if status.State == udp.Backoff || status.State == udp.AuthFailed {
+			line += fmt.Sprintf(", retry at %s", status.Retry.Format(time.Stamp))
+		}
+		if status.LastErr != nil {
+			line += fmt.Sprintf(", last error: %v", status.LastErr)
+		}
+		out.Println(line)
+		m := s.client.Metrics()
+		out.Printf("queue: %d waiting (%d %s, %d %s, %d %s), %d in flight, wait %s avg %s max, %d sent, %d answered, %d failed",
+			m.Depth(), m.Waiting[udp.Urgent], udp.Urgent, m.Waiting[udp.Normal], udp.Normal, m.Waiting[udp.Low], udp.Low,
+			m.Inflight, m.Wait.Truncate(time.Millisecond), m.MaxWait.Truncate(time.Millisecond), m.Sent, m.Answered, m.Failed)
+		if s.api != nil {
+			if s.api.Available() {
+				out.Println("player api: available")
+			} else {
+				out.Println("player api: unavailable (circuit breaker open)")
+			}
+		}
+	case "online":
+		for _, p := range s.registry.All() {
+			out.Printf("#%d %s %s %s:%d %dms verified=%t lobby=%t since %s", p.ID, p.Name, p.GUID, p.IP, p.Port, p.Ping, p.Verified, p.Lobby, p.Connected.Format(time.Stamp))
+		}
+	case "recheck":
+		// recheck <player id>, screens a player again with a fresh record
+		if len(rawstr) != 2 {
+			return fmt.Errorf("usage: recheck <player id>")
+		}
+		if s.ctx.Err() != nil {
+			return fmt.Errorf("server %s stopped", s.Name)
+		}
+		id, err := strconv.Atoi(rawstr[1])
+		if err != nil {
+			return err
+		}
+		p, ok := s.registry.Get(id)
+		if !ok || p.GUID == "" {
+			return fmt.Errorf("no player #%d with a known GUID", id)
+		}
+		if s.api != nil {
+			s.api.Forget(p.GUID)
+		}
+		s.registry.Update(id, p.GUID, func(player *players.Player) {
+			player.Checked = false
+		})
+		config, _ := s.settings()
+		dryRun := config.DryRun || s.replay
+		guid := p.GUID
+		s.spawn(func() {
+			s.admit(id, guid, dryRun)
+		})
+		out.Printf("rechecking #%d %s %s", p.ID, p.Name, p.GUID)
+	case "bansync":
+		if s.ctx.Err() != nil {
+			return fmt.Errorf("server %s stopped", s.Name)
+		}
+		s.spawn(s.syncBans)
+	case "capture":
+		// capture on|off
+		config, _ := s.settings()
+		switch {
+		case len(rawstr) == 2 && rawstr[1] == "on":
+			text, pcap := config.capture()
+			if err := s.client.StartCapture(text, pcap); err != nil {
+				return err
+			}
+			out.Printf("capturing to %s", text)
+		case len(rawstr) == 2 && rawstr[1] == "off":
+			return s.client.StopCapture()
+		default:
+			return fmt.Errorf("usage: capture on|off")
+		}
+	case "bans":
+		for _, b := range s.store.List() {
+			out.Println(b.String())
+		}
+	case "ban":
+		// ban <guid|ip> <minutes> [reason]
+		if len(rawstr) < 3 {
+			return fmt.Errorf("usage: ban <guid|ip> <minutes> [reason]")
+		}
+		minutes, err := strconv.Atoi(rawstr[2])
+		if err != nil {
+			return err
+		}
+		b := bans.Ban{Reason: strings.Join(rawstr[3:], " "), Issuer: "console"}
+		if net.ParseIP(rawstr[1]) != nil {
+			b.IP = rawstr[1]
+		} else {
+			b.GUID = rawstr[1]
+		}
+		// an IP ban has no GUID to look the player up by
+		if b.GUID != "" {
+			if p, ok := s.registry.ByGUID(b.GUID); ok {
+				b.Name, b.IP = p.Name, p.IP
+			}
+		}
+		if minutes > 0 {
+			b.Expires = time.Now().Add(time.Duration(minutes) * time.Minute)
+		}
+		b, err = s.store.Add(b)
+		if err != nil {
+			return err
+		}
+		out.Printf("added ban %s", b.String())
+	case "unban":
+		if len(rawstr) != 2 {
+			return fmt.Errorf("usage: unban <ban id>")
+		}
+		id, err := strconv.ParseUint(rawstr[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		b, err := s.store.Remove(id)
+		if err != nil {
+			return err
+		}
+		out.Printf("removed ban %s", b.String())
+	default:
+		return fmt.Errorf("unknown command (%s)", rawstr[0])
+	}
+	return nil
+}
+
+// send queues a command unless the server is shutting down, the client
+// no longer reads its queue then.
+func (s *Server) send(command string) error {
+	newpkt := battleye.NewBEClientCommand()
+	newpkt.Command = command
+	select {
+	case s.client.Out <- newpkt:
+		return nil
+	case <-s.ctx.Done():
+		return fmt.Errorf("server %s stopped (%s)", s.Name, command)
+	}
+}
+
+func (s *Server) handleMessages() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case p := <-s.client.MsgIn:
+			rawstring := p.Message
+			config, filter := s.settings()
+			dryRun := config.DryRun || s.replay
+			event := events.Parse(rawstring)
+			s.registry.Apply(event)
+			switch e := event.(type) {
+			case events.PlayerGUIDUnverified:
+				s.log.Printf("new player (#%d %s %s)", e.ID, e.Name, e.GUID)
+				if result, banned := s.enforceBan(e.ID, e.GUID, dryRun); banned {
+					s.kickLog <- fmt.Sprintf("#BAN %s %s", rawstring, result)
+					break
+				}
+				if s.screening() {
+					id, guid := e.ID, e.GUID
+					s.spawn(func() {
+						s.admit(id, guid, dryRun)
+					})
+				}
+			case events.PlayerGUIDVerified:
+				if result, banned := s.enforceBan(e.ID, e.GUID, dryRun); banned {
+					s.kickLog <- fmt.Sprintf("#BAN %s %s", rawstring, result)
+				}
+
+			case events.PlayerConnected:
+				// the restriction applies once the GUID is known
+				country := s.country(e.IP)
+				if country == "" {
+					country = "unknown"
+				}
+				s.log.Printf("connected (#%d %s %s %s)", e.ID, e.Name, e.IP, country)
+			case events.ChatMessage:
+				ct.ChangeColor(ct.Green, true, ct.Black, false)
+				s.log.Printf("chatmsg (%s)", rawstring)
+				ct.ResetColor()
+				if filter != nil {
+					sender, known := s.registry.ByName(e.Sender)
+				Rules:
+					for _, v := range filter.Rules {
+						if !v.Matches(e, sender.GUID) {
+							continue
+						}
+						switch v.Action {
+						case chatfilter.Log:
+							s.chatLog <- fmt.Sprintf("#%s %s", v.ID, rawstring)
+						case chatfilter.Print:
+							s.log.Printf("detection #%s %s\n", v.ID, rawstring)
+						case chatfilter.LogPrint:
+							s.log.Printf("detection #%s %s\n", v.ID, rawstring)
+							s.chatLog <- fmt.Sprintf("#%s %s", v.ID, rawstring)
+						case chatfilter.Simulate:
+							s.log.Printf("detection #%s %s %s\n", v.ID, rawstring, "[SIMULATED SILENT KICK]")
+							s.chatLog <- fmt.Sprintf("#%s %s", v.ID, rawstring)
+						case chatfilter.Kick:
+							result := s.punish(v, sender, known, false, dryRun)
+							s.kickLog <- fmt.Sprintf("#%s %s %s", v.ID, rawstring, result)
+							break Rules
+						case chatfilter.KickPrint:
+							result := s.punish(v, sender, known, false, dryRun)
+							s.log.Printf("detection #%s %s %s\n", v.ID, rawstring, result)
+							break Rules
+						case chatfilter.KickLogPrint:
+							result := s.punish(v, sender, known, false, dryRun)
+							s.log.Printf("detection #%s %s %s\n", v.ID, rawstring, result)
+							s.kickLog <- fmt.Sprintf("#%s %s %s", v.ID, rawstring, result)
+							break Rules
+						case chatfilter.Ban:
+							result := s.punish(v, sender, known, true, dryRun)
+							s.log.Printf("detection #%s %s %s\n", v.ID, rawstring, result)
+							s.banLog <- fmt.Sprintf("#%s %s %s", v.ID, rawstring, result)
+							break Rules
+						}
+					}
+				}
+			case events.PlayerKicked, events.FilterKick, events.PlayerBanned:
+				s.kickLog <- fmt.Sprintf("#SVR %s", rawstring)
+			default:
+				s.log.Printf("svmsg (%s)", rawstring)
+			}
+		}
+	}
+}
+
+func (s *Server) handleCommands() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case reply := <-s.client.CmdIn:
+			if reply.Err != nil {
+				s.errors <- reply.Err
+				continue
+			}
+			response := reply.Response
+			switch {
+			case strings.HasPrefix(response, "Players on server:"):
+				list := players.ParseList(response)
+				s.registry.Snapshot(list)
+				for _, p := range list {
+					s.log.Printf("#%d %s %s:%d %dms %s", p.ID, p.Name, p.IP, p.Port, p.Ping, p.GUID)
+				}
+				s.admitListed(list)
+			default:
+				ct.ChangeColor(ct.Magenta, true, ct.Black, false)
+				s.log.Printf("svcmd (%s)", response)
+				ct.ResetColor()
+			}
+		}
+	}
+}
+
+// pollPlayers refreshes the registry from the "players" command.
+func (s *Server) pollPlayers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		response, err := s.client.Send(s.ctx, "players")
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.errors <- err
+			}
+			continue
+		}
+		list := players.ParseList(response)
+		s.registry.Snapshot(list)
+		s.admitListed(list)
+	}
+}
+
+// punish kicks or bans the sender of a chat message and returns a short
+// description of what has been done for the logs.
+func (s *Server) punish(v *chatfilter.Rule, p players.Player, known bool, ban bool, dryRun bool) string {
+	if !known {
+		s.errors <- fmt.Errorf("detection #%s: unknown player", v.ID)
+		return "[UNKNOWN PLAYER]"
+	}
+	reason := v.FormatReason(p.ID, p.Name, p.GUID)
+
+	switch {
+	case ban && dryRun:
+		return fmt.Sprintf("[SIMULATED BAN #%d %s %dmin: %s]", p.ID, p.GUID, v.BanMinutes, reason)
+	case dryRun:
+		return fmt.Sprintf("[SIMULATED KICK #%d: %s]", p.ID, reason)
+	case ban:
+		if err := s.banPlayer(p, v.BanMinutes, reason); err != nil {
+			s.errors <- fmt.Errorf("detection #%s: ban #%d failed: %v", v.ID, p.ID, err)
+			return fmt.Sprintf("[BAN #%d %s FAILED: %s]", p.ID, p.GUID, reason)
+		}
+		b := bans.Ban{GUID: p.GUID, IP: p.IP, Name: p.Name, Reason: reason, Issuer: "rule " + v.ID}
+		if v.BanMinutes > 0 {
+			b.Expires = time.Now().Add(time.Duration(v.BanMinutes) * time.Minute)
+		}
+		if _, err := s.store.Add(b); err != nil {
+			s.errors <- err
+		}
+		return fmt.Sprintf("[BAN #%d %s %dmin: %s]", p.ID, p.GUID, v.BanMinutes, reason)
+	default:
+		if err := s.client.KickPlayerById(int16(p.ID), reason); err != nil {
+			s.errors <- fmt.Errorf("detection #%s: kick #%d failed: %v", v.ID, p.ID, err)
+			return fmt.Sprintf("[KICK #%d FAILED: %s]", p.ID, reason)
+		}
+		return fmt.Sprintf("[KICK #%d: %s]", p.ID, reason)
+	}
+}
+
+// banPlayer bans a player by GUID when it is known, so the ban does not
+// depend on the slot still holding the same player, and kicks the slot.
+func (s *Server) banPlayer(p players.Player, minutes int, reason string) error {
+	if p.GUID == "" {
+		return s.client.BanPlayerById(int16(p.ID), minutes, reason)
+	}
+	if err := s.client.AddBan(p.GUID, minutes, reason); err != nil {
+		return err
+	}
+	return s.client.KickPlayerById(int16(p.ID), reason)
+}
+
+// enforceBan kicks the player in a slot if the local ban database holds
+// an active ban for its GUID or IP.
+func (s *Server) enforceBan(id int, guid string, dryRun bool) (string, bool) {
+	var ip string
+	if p, ok := s.registry.Get(id); ok {
+		ip = p.IP
+	}
+	b, banned := s.store.Find(guid, ip, time.Now())
+	if !banned {
+		return "", false
+	}
+	reason := "Banned: " + b.Reason
+	if !b.Permanent() {
+		reason = fmt.Sprintf("%s (%s left)", reason, b.Remaining(time.Now()).Truncate(time.Minute))
+	}
+	if dryRun {
+		return fmt.Sprintf("[SIMULATED KICK #%d: %s] ban #%d", id, reason, b.ID), true
+	}
+	if err := s.client.KickPlayerById(int16(id), reason); err != nil {
+		s.errors <- fmt.Errorf("ban #%d: kick #%d failed: %v", b.ID, id, err)
+		return fmt.Sprintf("[KICK #%d FAILED: %s] ban #%d", id, reason, b.ID), true
+	}
+	return fmt.Sprintf("[KICK #%d: %s] ban #%d", id, reason, b.ID), true
+}
+
+// syncBans reconciles the local ban database with the bans list of
+// battleye and logs every divergence.
+func (s *Server) syncBans() {
+	config, _ := s.settings()
+	syncer := &bans.Syncer{Store: s.store, Client: s.client, DryRun: config.DryRun}
+	report, err := syncer.Sync(s.ctx)
+	if report != nil {
+		for _, line := range report.Lines() {
+			s.banLog <- "#SYNC " + line
+		}
+	}
+	if err != nil {
+		s.errors <- fmt.Errorf("ban sync failed: %v", err)
+	}
+}
+
+// federate exchanges bans with the shared ban lists.
+func (s *Server) federate(config ServerConfig, interval time.Duration) {
+	federation := &bans.Federation{Self: s.Name, Store: s.store, Sources: config.BanSources}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		lines, err := federation.Sync()
+		for _, line := range lines {
+			s.banLog <- "#SHARED " + line
+		}
+		if err != nil {
+			s.errors <- err
+		}
+	}
+}
+
+// expireBans lifts temporary bans once they have run out.
+func (s *Server) expireBans(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		lifted, err := s.store.Expire(now)
+		if err != nil {
+			s.errors <- err
+		}
+		for _, b := range lifted {
+			s.banLog <- fmt.Sprintf("#EXPIRED %s", b.String())
+		}
+	}
+}
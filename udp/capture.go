@@ -0,0 +1,241 @@
+package udp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"ghosthunter/battleye"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is one captured packet.
+type Record struct {
+	Time      time.Time
+	Direction battleye.Direction
+	Packet    []byte
+}
+
+// Capture writes packets to a text file with one
+// "<RFC3339 time> <server|client> <hex packet>" line per packet and
+// optionally to a pcap file for wireshark.
+type Capture struct {
+	text  *os.File
+	pcap  *os.File
+	mutex *sync.Mutex
+}
+
+// OpenCapture appends to filename and, unless pcap is empty, to a pcap
+// file.
+func OpenCapture(filename string, pcap string) (*Capture, error) {
+	text, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{text: text, mutex: &sync.Mutex{}}
+	if pcap == "" {
+		return c, nil
+	}
+	c.pcap, err = os.OpenFile(pcap, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		text.Close()
+		return nil, err
+	}
+	if info, err := c.pcap.Stat(); err == nil && info.Size() == 0 {
+		// magic, version 2.4, timezone, accuracy, snaplen, raw ip
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], 65535)
+		binary.LittleEndian.PutUint32(header[20:], 101)
+		c.pcap.Write(header)
+	}
+	return c, nil
+}
+
+// Write records a packet sent from src to dst. The password of a client
+// login is replaced, captures are meant to be shared.
+func (c *Capture) Write(t time.Time, d battleye.Direction, src, dst *net.UDPAddr, packet []byte) error {
+	packet = redact(d, packet)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := fmt.Fprintf(c.text, "%s %s %x\n", t.Format(time.RFC3339Nano), d, packet)
+	if err != nil || c.pcap == nil {
+		return err
+	}
+	frame := udpFrame(src, dst, packet)
+	record := make([]byte, 16, 16+len(frame))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	_, err = c.pcap.Write(append(record, frame...))
+	return err
+}
+
+// Close flushes and closes the files.
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.text.Sync()
+	err := c.text.Close()
+	if c.pcap != nil {
+		c.pcap.Sync()
+		if perr := c.pcap.Close(); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// redact returns a client login packet with the password replaced by
+// asterisks and a matching CRC, so replays can still decode it. Other
+// packets are returned as they are.
+func redact(d battleye.Direction, packet []byte) []byte {
+	if d != battleye.FromClient || len(packet) < 8 || packet[7] != 0x00 {
+		return packet
+	}
+	login := battleye.NewBEClientLogin()
+	login.Password = "********"
+	redacted, err := login.Marshal()
+	if err != nil {
+		return packet[:8]
+	}
+	return redacted
+}
+
+// udpFrame wraps a packet into an ip and udp header. The udp checksum is
+// left out.
+func udpFrame(src, dst *net.UDPAddr, packet []byte) []byte {
+	u := make([]byte, 8, 8+len(packet))
+	binary.BigEndian.PutUint16(u[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(u[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(u[4:], uint16(8+len(packet)))
+	u = append(u, packet...)
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(u)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src.IP.To4())
+		copy(ip[16:], dst.IP.To4())
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+		}
+		for sum > 0xffff {
+			sum = sum&0xffff + sum>>16
+		}
+		binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+		return append(ip, u...)
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(u)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	return append(ip, u...)
+}
+
+// ReadCapture parses a text capture.
+func ReadCapture(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid capture line %d", n)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture line %d: %v", n, err)
+		}
+		var d battleye.Direction
+		switch fields[1] {
+		case battleye.FromServer.String():
+			d = battleye.FromServer
+		case battleye.FromClient.String():
+			d = battleye.FromClient
+		default:
+			return nil, fmt.Errorf("invalid capture line %d: direction (%s)", n, fields[1])
+		}
+		packet, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture line %d: %v", n, err)
+		}
+		records = append(records, Record{Time: t, Direction: d, Packet: packet})
+	}
+	return records, scanner.Err()
+}
+
+// StartCapture records every packet sent or received from now on, see
+// OpenCapture.
+func (u *UDPClient) StartCapture(filename string, pcap string) error {
+	c, err := OpenCapture(filename, pcap)
+	if err != nil {
+		return err
+	}
+	u.captureMutex.Lock()
+	old := u.capture
+	u.capture = c
+	u.captureMutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// StopCapture stops recording and closes the capture files.
+func (u *UDPClient) StopCapture() error {
+	u.captureMutex.Lock()
+	c := u.capture
+	u.capture = nil
+	u.captureMutex.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.Close()
+}
+
+// record hands a packet to the capture if there is one.
+func (u *UDPClient) record(d battleye.Direction, con *net.UDPConn, packet []byte) {
+	u.captureMutex.Lock()
+	defer u.captureMutex.Unlock()
+	if u.capture == nil {
+		return
+	}
+	local, _ := con.LocalAddr().(*net.UDPAddr)
+	remote, _ := con.RemoteAddr().(*net.UDPAddr)
+	if local == nil || remote == nil {
+		return
+	}
+	src, dst := remote, local
+	if d == battleye.FromClient {
+		src, dst = local, remote
+	}
+	if err := u.capture.Write(time.Now(), d, src, dst, packet); err != nil {
+		// give up instead of failing on every packet
+		u.capture.Close()
+		u.capture = nil
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		go func() {
+			u.report(ctx, fmt.Errorf("capture stopped: %v", err))
+			cancel()
+		}()
+	}
+}
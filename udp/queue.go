@@ -0,0 +1,384 @@
+package udp
+
+import (
+	"fmt"
+	"ghosthunter/battleye"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides how long a command may take to be answered.
+type Policy struct {
+	Timeout  time.Duration // give up this long after the command was queued
+	Retries  int           // resends after the first attempt
+	Interval time.Duration // wait between attempts
+}
+
+var DefaultPolicy = Policy{Timeout: 30 * time.Second, Retries: 5, Interval: time.Second}
+
+// Priority decides which waiting command is sent first. Commands of a
+// lower priority wait as long as there are commands of a higher one.
+type Priority byte
+
+const (
+	Urgent Priority = iota // kicks and bans
+	Normal                 // admin commands
+	Low                    // broadcasts and polls
+	priorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Urgent:
+		return "urgent"
+	case Normal:
+		return "normal"
+	case Low:
+		return "low"
+	}
+	return fmt.Sprintf("Priority(%d)", byte(p))
+}
+
+// DefaultPriorities maps command names to priorities, everything else is
+// Normal.
+var DefaultPriorities = map[string]Priority{
+	"kick":    Urgent,
+	"ban":     Urgent,
+	"addBan":  Urgent,
+	"say":     Low,
+	"players": Low,
+	"bans":    Low,
+	"":        Low,
+}
+
+const (
+	DefaultMaxInflight = 32
+	maxInflight        = 128 // keeps half of the sequence numbers unused
+)
+
+// request is a command waiting for its reply. Commands issued through
+// Send have a reply channel; commands from Out are answered on CmdIn.
+type request struct {
+	packet    *battleye.BEClientCommand
+	reply     chan Reply
+	done      chan struct{} // closed once the sender has stopped waiting
+	policy    Policy
+	priority  Priority
+	heartbeat bool
+	queued    time.Time
+	sent      time.Time
+	attempts  int
+	bytes     []byte
+}
+
+// abandoned reports whether nobody waits for the reply anymore.
+func (r *request) abandoned() bool {
+	if r.done == nil {
+		return false
+	}
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Metrics describes the outbound queue.
+type Metrics struct {
+	Waiting  [priorities]int // commands not sent yet by priority
+	Inflight int             // commands sent but not answered
+	Sent     uint64          // commands sent for the first time
+	Answered uint64
+	Failed   uint64
+	Wait     time.Duration // average time commands wait before they are sent
+	MaxWait  time.Duration // longest wait so far
+}
+
+// Depth returns the number of commands not sent yet.
+func (m Metrics) Depth() int {
+	n := 0
+	for _, w := range m.Waiting {
+		n += w
+	}
+	return n
+}
+
+// queue holds commands until they are sent and then until they are
+// answered. A sequence number is never reused while its command is in
+// flight. It is only used by ProcessPendingPackets.
+type queue struct {
+	waiting  [priorities][]*request
+	inflight map[byte]*request
+	max      int
+	session  int
+
+	// token bucket, a rate of 0 means unlimited
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	metrics Metrics
+}
+
+func newQueue(max int, rate int) *queue {
+	if max <= 0 {
+		max = DefaultMaxInflight
+	}
+	if max > maxInflight {
+		max = maxInflight
+	}
+	return &queue{inflight: make(map[byte]*request), max: max, rate: float64(rate), tokens: float64(rate)}
+}
+
+func (q *queue) push(r *request, now time.Time) {
+	r.queued = now
+	q.waiting[r.priority] = append(q.waiting[r.priority], r)
+}
+
+func (q *queue) empty() bool {
+	return !q.pending() && len(q.inflight) == 0
+}
+
+// next removes the first waiting command of the highest priority.
+func (q *queue) next() *request {
+	for p, lane := range q.waiting {
+		if len(lane) > 0 {
+			q.waiting[p] = lane[1:]
+			return lane[0]
+		}
+	}
+	return nil
+}
+
+// live drops abandoned commands from the front of the lanes and reports
+// whether a command is left to send.
+func (q *queue) live() bool {
+	for p, lane := range q.waiting {
+		for len(lane) > 0 && lane[0].abandoned() {
+			lane = lane[1:]
+		}
+		q.waiting[p] = lane
+		if len(lane) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// beat removes a waiting heartbeat. It goes out ahead of everything else,
+// the server drops clients it has not heard from in about 45 seconds.
+func (q *queue) beat() *request {
+	for p, lane := range q.waiting {
+		for i, r := range lane {
+			if r.heartbeat {
+				q.waiting[p] = append(lane[:i:i], lane[i+1:]...)
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// allow takes a token from the bucket if there is one.
+func (q *queue) allow(now time.Time) bool {
+	if q.rate <= 0 {
+		return true
+	}
+	if !q.last.IsZero() {
+		q.tokens += now.Sub(q.last).Seconds() * q.rate
+	}
+	q.last = now
+	// allow a burst of one second
+	if q.tokens > q.rate {
+		q.tokens = q.rate
+	}
+	if q.tokens < 1 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+// fill sends waiting commands while there is room in flight and the rate
+// limit allows it and returns the sequence numbers it has used. Resends
+// and the heartbeat are not rate limited, the room in flight bounds them.
+func (q *queue) fill(u *UDPClient, now time.Time) []byte {
+	var used []byte
+	for len(q.inflight) < q.max {
+		r := q.beat()
+		if r == nil {
+			// abandoned commands must not use up tokens
+			if !q.live() || !q.allow(now) {
+				break
+			}
+			r = q.next()
+		}
+		bytes, err := r.packet.Marshal()
+		if err != nil {
+			continue
+		}
+		seq := u.sequence(bytes, q.inflight)
+		if r.attempts == 0 {
+			q.waited(now.Sub(r.queued))
+		}
+		r.bytes = bytes
+		r.attempts = 1
+		r.sent = now
+		q.inflight[seq] = r
+		used = append(used, seq)
+		u.write(bytes)
+	}
+	return used
+}
+
+// pending reports whether commands wait to be sent.
+func (q *queue) pending() bool {
+	for _, lane := range q.waiting {
+		if len(lane) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// waited records how long a command has waited to be sent.
+func (q *queue) waited(d time.Duration) {
+	m := &q.metrics
+	m.Sent++
+	if d > m.MaxWait {
+		m.MaxWait = d
+	}
+	// moving average over roughly the last 20 commands
+	m.Wait += (d - m.Wait) / 20
+}
+
+// retry resends unanswered commands while online and returns those that
+// have run out of time or attempts.
+func (q *queue) retry(u *UDPClient, now time.Time, online bool) []*request {
+	var failed []*request
+	for p, lane := range q.waiting {
+		waiting := lane[:0]
+		for _, r := range lane {
+			switch {
+			case r.abandoned():
+			case now.Sub(r.queued) >= r.policy.Timeout:
+				failed = append(failed, r)
+			default:
+				waiting = append(waiting, r)
+			}
+		}
+		q.waiting[p] = waiting
+	}
+	for seq, r := range q.inflight {
+		switch {
+		case r.abandoned():
+			delete(q.inflight, seq)
+		case now.Sub(r.queued) >= r.policy.Timeout:
+			delete(q.inflight, seq)
+			failed = append(failed, r)
+		case !online || now.Sub(r.sent) < r.policy.Interval:
+		case r.attempts > r.policy.Retries:
+			delete(q.inflight, seq)
+			failed = append(failed, r)
+		default:
+			r.attempts++
+			r.sent = now
+			u.write(r.bytes)
+		}
+	}
+	q.metrics.Failed += uint64(len(failed))
+	return failed
+}
+
+// answer removes the command a reply belongs to from the queue.
+func (q *queue) answer(seq byte) *request {
+	r := q.inflight[seq]
+	delete(q.inflight, seq)
+	if r != nil {
+		q.metrics.Answered++
+	}
+	return r
+}
+
+// requeue puts the commands in flight back in front of the waiting ones,
+// the sequence numbers of a previous connection mean nothing to the server.
+func (q *queue) requeue() {
+	var requeued []*request
+	for seq, r := range q.inflight {
+		requeued = append(requeued, r)
+		delete(q.inflight, seq)
+	}
+	// newest first, each one goes in front of the lane
+	sort.Slice(requeued, func(i, j int) bool {
+		return requeued[i].queued.After(requeued[j].queued)
+	})
+	for _, r := range requeued {
+		q.waiting[r.priority] = append([]*request{r}, q.waiting[r.priority]...)
+	}
+}
+
+// clear removes and returns every command.
+func (q *queue) clear() []*request {
+	q.requeue()
+	var all []*request
+	for p, lane := range q.waiting {
+		all = append(all, lane...)
+		q.waiting[p] = nil
+	}
+	return all
+}
+
+// snapshot returns the current metrics.
+func (q *queue) snapshot() Metrics {
+	m := q.metrics
+	for p, lane := range q.waiting {
+		m.Waiting[p] = len(lane)
+	}
+	m.Inflight = len(q.inflight)
+	return m
+}
+
+// SetPolicy sets the policy of every command starting with name, the
+// empty name is the heartbeat.
+func (u *UDPClient) SetPolicy(name string, p Policy) {
+	u.cmdMutex.Lock()
+	u.policies[name] = p
+	u.cmdMutex.Unlock()
+}
+
+// SetPriority sets the priority of every command starting with name.
+func (u *UDPClient) SetPriority(name string, p Priority) {
+	u.cmdMutex.Lock()
+	u.priorities[name] = p
+	u.cmdMutex.Unlock()
+}
+
+// request wraps a command for the queue.
+func (u *UDPClient) request(packet *battleye.BEClientCommand) *request {
+	name := strings.SplitN(packet.Command, " ", 2)[0]
+	r := &request{packet: packet, policy: DefaultPolicy, priority: Normal}
+	u.cmdMutex.Lock()
+	defer u.cmdMutex.Unlock()
+	if p, ok := u.policies[name]; ok {
+		r.policy = p
+	}
+	if p, ok := u.priorities[name]; ok {
+		r.priority = p
+	}
+	return r
+}
+
+// Metrics returns the state of the outbound queue.
+func (u *UDPClient) Metrics() Metrics {
+	u.metricsMutex.Lock()
+	defer u.metricsMutex.Unlock()
+	return u.metrics
+}
+
+func (u *UDPClient) publish(m Metrics) {
+	u.metricsMutex.Lock()
+	u.metrics = m
+	u.metricsMutex.Unlock()
+}
@@ -0,0 +1,53 @@
+package udp
+
+import (
+	"ghosthunter/battleye"
+	"testing"
+	"time"
+)
+
+func command(u *UDPClient, text string) *request {
+	p := battleye.NewBEClientCommand()
+	p.Command = text
+	return u.request(p)
+}
+
+func TestFillRateLimit(t *testing.T) {
+	u := NewUDPClient(&Config{})
+	q := newQueue(DefaultMaxInflight, 2)
+	now := time.Now()
+
+	// abandoned commands are dropped without using up the bucket
+	for i := 0; i < 5; i++ {
+		r := command(u, "say -1 gone")
+		r.done = make(chan struct{})
+		close(r.done)
+		q.push(r, now)
+	}
+	q.push(command(u, "kick 1"), now)
+	q.push(command(u, "kick 2"), now)
+	q.push(command(u, "players"), now)
+	if used := q.fill(u, now); len(used) != 2 {
+		t.Fatalf("sent %d commands, want 2", len(used))
+	}
+	for _, r := range q.inflight {
+		if r.packet.Command == "players" {
+			t.Errorf("sent %q ahead of the kicks", r.packet.Command)
+		}
+	}
+
+	// the bucket is empty, the heartbeat still goes out
+	beat := command(u, "")
+	beat.heartbeat = true
+	q.push(beat, now)
+	used := q.fill(u, now)
+	if len(used) != 1 || q.inflight[used[0]] != beat {
+		t.Fatalf("heartbeat not sent: %v", used)
+	}
+	if !q.pending() {
+		t.Error("players dropped")
+	}
+	if used := q.fill(u, now.Add(time.Second)); len(used) != 1 || q.pending() {
+		t.Errorf("players not sent once the bucket refilled: %v", used)
+	}
+}
@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"fmt"
+	"ghosthunter/battleye"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultReassemblyWindow = 10 * time.Second
+)
+
+// Reply is a complete answer of the server to one command.
+type Reply struct {
+	Sequence byte
+	Command  string // empty for replies nobody has asked for
+	Response string
+	Err      error
+}
+
+type fragments struct {
+	parts    []string
+	seen     []bool
+	received int
+	started  time.Time
+}
+
+// Reassembler joins multipart command replies (see battleye.BEOptionalHeader).
+// Fragments are deduplicated by index, partial replies expire after Window
+// and every sequence yields exactly one Reply until it is forgotten.
+// It is not safe for concurrent use.
+type Reassembler struct {
+	Window   time.Duration
+	partial  map[byte]*fragments
+	complete map[byte]time.Time
+}
+
+func NewReassembler(window time.Duration) *Reassembler {
+	if window <= 0 {
+		window = DefaultReassemblyWindow
+	}
+	return &Reassembler{
+		Window:   window,
+		partial:  make(map[byte]*fragments),
+		complete: make(map[byte]time.Time),
+	}
+}
+
+// Add feeds a reply packet into the reassembler. It returns the complete
+// reply once all fragments of the sequence have arrived.
+func (r *Reassembler) Add(p battleye.BEServerCommand) (*Reply, bool) {
+	return r.AddAt(p, time.Now())
+}
+
+// AddAt is Add for a packet received at now, as when reading a capture.
+func (r *Reassembler) AddAt(p battleye.BEServerCommand, now time.Time) (*Reply, bool) {
+	if _, done := r.complete[p.Sequence]; done {
+		// resent by the server, already answered
+		return nil, false
+	}
+	if p.OptionalHeader == nil {
+		return r.finish(p.Sequence, p.Response, now), true
+	}
+
+	total := int(p.OptionalHeader.NumberOfPackets)
+	index := int(p.OptionalHeader.Index)
+	if total == 0 || index >= total {
+		return &Reply{Sequence: p.Sequence, Err: fmt.Errorf("invalid reply fragment %d/%d (sequence %d)", index, total, p.Sequence)}, true
+	}
+
+	f := r.partial[p.Sequence]
+	if f == nil || len(f.parts) != total {
+		f = &fragments{
+			parts:   make([]string, total),
+			seen:    make([]bool, total),
+			started: now,
+		}
+		r.partial[p.Sequence] = f
+	}
+	if f.seen[index] {
+		return nil, false
+	}
+	f.parts[index] = p.Response
+	f.seen[index] = true
+	f.received++
+	if f.received < total {
+		return nil, false
+	}
+	return r.finish(p.Sequence, strings.Join(f.parts, ""), now), true
+}
+
+func (r *Reassembler) finish(seq byte, response string, now time.Time) *Reply {
+	delete(r.partial, seq)
+	r.complete[seq] = now
+	return &Reply{Sequence: seq, Response: response}
+}
+
+// Forget clears all state of a sequence so it can be reused by a new command.
+func (r *Reassembler) Forget(seq byte) {
+	delete(r.partial, seq)
+	delete(r.complete, seq)
+}
+
+// Expire drops state older than Window and returns an error reply for
+// every partial reply that never completed.
+func (r *Reassembler) Expire(now time.Time) []Reply {
+	var expired []Reply
+	for seq, f := range r.partial {
+		if now.Sub(f.started) >= r.Window {
+			delete(r.partial, seq)
+			r.complete[seq] = now
+			expired = append(expired, Reply{
+				Sequence: seq,
+				Err:      fmt.Errorf("incomplete reply (sequence %d): %d of %d packets", seq, f.received, len(f.parts)),
+			})
+		}
+	}
+	for seq, t := range r.complete {
+		if now.Sub(t) >= r.Window {
+			delete(r.complete, seq)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,109 @@
+package udp
+
+import (
+	"ghosthunter/battleye"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// part is a step fed to a Reassembler: a reply packet, or with expire set
+// a call of Expire that far ahead, or with forget set a call of Forget.
+type part struct {
+	seq, total, index byte // total 0 sends a reply without optional header
+	text              string
+	expire            time.Duration
+	forget            bool
+}
+
+func TestReassembler(t *testing.T) {
+	const window = time.Second
+	tests := []struct {
+		name  string
+		parts []part
+		want  []string // responses, errors with their message
+	}{
+		{"single", []part{{seq: 1, text: "hello"}}, []string{"hello"}},
+		{"in order", []part{{1, 3, 0, "a", 0, false}, {1, 3, 1, "b", 0, false}, {1, 3, 2, "c", 0, false}}, []string{"abc"}},
+		{"out of order", []part{{1, 3, 2, "c", 0, false}, {1, 3, 0, "a", 0, false}, {1, 3, 1, "b", 0, false}}, []string{"abc"}},
+		{"duplicate parts", []part{{1, 2, 0, "a", 0, false}, {1, 2, 0, "a", 0, false}, {1, 2, 1, "b", 0, false}}, []string{"ab"}},
+		{"interleaved", []part{{1, 2, 0, "a", 0, false}, {2, 2, 1, "y", 0, false}, {1, 2, 1, "b", 0, false}, {2, 2, 0, "x", 0, false}}, []string{"ab", "xy"}},
+		{
+			// the server has answered a resend anew, only the new parts count
+			"part count changes",
+			[]part{{1, 2, 0, "a", 0, false}, {1, 3, 0, "x", 0, false}, {1, 3, 2, "z", 0, false}, {1, 3, 1, "y", 0, false}},
+			[]string{"xyz"},
+		},
+		{"invalid index", []part{{1, 2, 2, "a", 0, false}}, []string{"invalid reply fragment 2/2 (sequence 1)"}},
+		{
+			"expire incomplete",
+			[]part{{1, 3, 0, "a", 0, false}, {2, 2, 0, "x", 0, false}, {2, 2, 1, "y", 0, false}, {expire: window}, {1, 3, 1, "b", 0, false}, {1, 3, 2, "c", 0, false}},
+			[]string{"xy", "incomplete reply (sequence 1): 1 of 3 packets"},
+		},
+		{"expire in time", []part{{1, 2, 0, "a", 0, false}, {expire: window / 2}, {1, 2, 1, "b", 0, false}}, []string{"ab"}},
+		{
+			"exactly once",
+			[]part{{1, 2, 0, "a", 0, false}, {1, 2, 1, "b", 0, false}, {1, 2, 1, "b", 0, false}, {1, 2, 0, "a", 0, false}, {seq: 1, text: "ab"}},
+			[]string{"ab"},
+		},
+		{
+			"reused after forget",
+			[]part{{seq: 1, text: "first"}, {seq: 1, text: "first"}, {seq: 1, forget: true}, {seq: 1, text: "second"}},
+			[]string{"first", "second"},
+		},
+		{
+			"reused after the window",
+			[]part{{seq: 1, text: "first"}, {expire: window}, {seq: 1, text: "second"}},
+			[]string{"first", "second"},
+		},
+	}
+	for _, test := range tests {
+		r := NewReassembler(window)
+		var got []string
+		for _, p := range test.parts {
+			var replies []Reply
+			switch {
+			case p.expire > 0:
+				replies = r.Expire(time.Now().Add(p.expire))
+			case p.forget:
+				r.Forget(p.seq)
+			default:
+				packet := *battleye.NewBEServerCommand()
+				packet.Sequence = p.seq
+				packet.Response = p.text
+				if p.total > 0 {
+					packet.OptionalHeader = &battleye.BEOptionalHeader{NumberOfPackets: p.total, Index: p.index}
+				}
+				if reply, ok := r.Add(packet); ok {
+					replies = append(replies, *reply)
+				}
+			}
+			for _, reply := range replies {
+				if reply.Err != nil {
+					got = append(got, reply.Err.Error())
+				} else {
+					got = append(got, reply.Response)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReassemblerCaptureTime(t *testing.T) {
+	r := NewReassembler(time.Second)
+	captured := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	packet := *battleye.NewBEServerCommand()
+	packet.Sequence = 1
+	packet.OptionalHeader = &battleye.BEOptionalHeader{NumberOfPackets: 2}
+	r.AddAt(packet, captured)
+
+	if expired := r.Expire(captured.Add(time.Second / 2)); len(expired) != 0 {
+		t.Errorf("expired early: %+v", expired)
+	}
+	if expired := r.Expire(captured.Add(time.Second)); len(expired) != 1 || expired[0].Err == nil {
+		t.Errorf("got %+v", expired)
+	}
+}
@@ -0,0 +1,162 @@
+package udp
+
+import (
+	"math/rand"
+	"time"
+)
+
+type State int
+
+const (
+	Disconnected State = iota
+	Connecting
+	Authenticating
+	Online
+	AuthFailed
+	Backoff
+)
+
+var stateNames = []string{"disconnected", "connecting", "authenticating", "online", "auth failed", "backoff"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+// StateChange is published to subscribers on every transition.
+type StateChange struct {
+	From State
+	To   State
+	Err  error // cause of the transition, if any
+	Time time.Time
+}
+
+// Status is a snapshot of the connection.
+type Status struct {
+	State    State
+	Since    time.Time
+	Attempts int // failed connection attempts since last online
+	LastErr  error
+	Retry    time.Time // next attempt while in Backoff
+}
+
+const (
+	DefaultBackoffMin = 1 * time.Second
+	DefaultBackoffMax = 60 * time.Second
+)
+
+// State returns the current connection state.
+func (u *UDPClient) State() State {
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	return u.status.State
+}
+
+func (u *UDPClient) Status() Status {
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	return u.status
+}
+
+// Subscribe returns a channel receiving every state change. Slow
+// subscribers miss changes rather than block the client.
+func (u *UDPClient) Subscribe() <-chan StateChange {
+	c := make(chan StateChange, 16)
+	u.stateMutex.Lock()
+	u.subscribers = append(u.subscribers, c)
+	u.stateMutex.Unlock()
+	return c
+}
+
+func (u *UDPClient) Unsubscribe(c <-chan StateChange) {
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	for i, s := range u.subscribers {
+		if s == c {
+			u.subscribers = append(u.subscribers[:i], u.subscribers[i+1:]...)
+			close(s)
+			return
+		}
+	}
+}
+
+func (u *UDPClient) setState(s State, err error) {
+	now := time.Now()
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	change := StateChange{From: u.status.State, To: s, Err: err, Time: now}
+	if s != u.status.State {
+		u.status.Since = now
+	}
+	u.status.State = s
+	if err != nil {
+		u.status.LastErr = err
+	}
+	switch s {
+	case Online:
+		u.status.Attempts = 0
+	case Backoff, AuthFailed:
+		u.status.Attempts++
+	}
+	for _, c := range u.subscribers {
+		select {
+		case c <- change:
+		default:
+		}
+	}
+}
+
+// backoff returns the delay before the next connection attempt:
+// exponential in the number of failed attempts, capped, with jitter in
+// the upper half so reconnecting clients spread out.
+func (u *UDPClient) backoff(attempts int) time.Duration {
+	min, max := u.backoffRange()
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (u *UDPClient) maxBackoff() time.Duration {
+	_, max := u.backoffRange()
+	return max
+}
+
+func (u *UDPClient) backoffRange() (time.Duration, time.Duration) {
+	min := time.Duration(u.cfg.BackoffMin) * time.Second
+	max := time.Duration(u.cfg.BackoffMax) * time.Second
+	if min <= 0 {
+		min = DefaultBackoffMin
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// wait sleeps in Backoff before the next connection attempt.
+func (u *UDPClient) wait(err error) {
+	u.setState(Backoff, err)
+	u.retry(u.backoff(u.Status().Attempts))
+}
+
+func (u *UDPClient) retry(d time.Duration) {
+	u.stateMutex.Lock()
+	u.status.Retry = time.Now().Add(d)
+	u.stateMutex.Unlock()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-u.drained:
+	}
+}
@@ -0,0 +1,119 @@
+package udp
+
+import (
+	"context"
+	"ghosthunter/emulator"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		cfg      Config
+		attempts int
+		max      time.Duration // the delay lies in the upper half below it
+	}{
+		{Config{BackoffMin: 2, BackoffMax: 30}, 0, 2 * time.Second},
+		{Config{BackoffMin: 2, BackoffMax: 30}, 1, 2 * time.Second},
+		{Config{BackoffMin: 2, BackoffMax: 30}, 2, 4 * time.Second},
+		{Config{BackoffMin: 2, BackoffMax: 30}, 4, 16 * time.Second},
+		{Config{BackoffMin: 2, BackoffMax: 30}, 5, 30 * time.Second},
+		{Config{BackoffMin: 2, BackoffMax: 30}, 100, 30 * time.Second},
+		{Config{}, 1, DefaultBackoffMin},
+		{Config{}, 100, DefaultBackoffMax},
+		// a maximum below the minimum is raised to it
+		{Config{BackoffMin: 10, BackoffMax: 5}, 3, 10 * time.Second},
+	}
+	for _, test := range tests {
+		u := NewUDPClient(&test.cfg)
+		spread := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			d := u.backoff(test.attempts)
+			if d < test.max/2 || d > test.max {
+				t.Errorf("%+v after %d attempts: %v, want between %v and %v", test.cfg, test.attempts, d, test.max/2, test.max)
+				break
+			}
+			spread[d] = true
+		}
+		if len(spread) < 2 {
+			t.Errorf("%+v after %d attempts: no jitter", test.cfg, test.attempts)
+		}
+	}
+}
+
+// expect reads state changes until it has seen want in order.
+func expect(t *testing.T, changes <-chan StateChange, want ...State) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for _, s := range want {
+		select {
+		case c := <-changes:
+			if c.To != s {
+				t.Fatalf("got %v -> %v, want %v", c.From, c.To, s)
+			}
+		case <-timeout:
+			t.Fatalf("no change to %v", s)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	_, client, _, _ := start(t, emulator.Config{})
+	changes := client.Subscribe()
+	other := client.Subscribe()
+	client.Unsubscribe(other)
+	if _, ok := <-other; ok {
+		t.Error("unsubscribed channel not closed")
+	}
+
+	// the connection is lost
+	client.drop()
+	expect(t, changes, Backoff, Connecting, Authenticating, Online)
+	if s := client.Status(); s.Attempts != 0 || s.LastErr == nil {
+		t.Errorf("status %+v", s)
+	}
+}
+
+func TestAuthFailedWaits(t *testing.T) {
+	server, err := emulator.New(emulator.Config{Addr: "127.0.0.1:0", Password: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+
+	client := NewUDPClient(&Config{Server: server.Addr(), Rconpw: "wrong", ShutdownGrace: 1, BackoffMin: 1, BackoffMax: 60})
+	changes := client.Subscribe()
+	go func() {
+		for {
+			select {
+			case <-client.Err:
+			case <-client.drained:
+				return
+			}
+		}
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(stopped)
+	}()
+
+	expect(t, changes, Connecting, Authenticating, AuthFailed)
+	// a wrong password is not retried soon
+	select {
+	case c := <-changes:
+		t.Errorf("changed to %v after a failed login", c.To)
+	case <-time.After(2 * time.Second):
+	}
+	if s := client.Status(); s.State != AuthFailed || time.Until(s.Retry) < 50*time.Second {
+		t.Errorf("status %+v", s)
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not stop while waiting after a failed login")
+	}
+}
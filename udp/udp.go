@@ -1,7 +1,7 @@
 package udp
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"ghosthunter/battleye"
 	"net"
@@ -10,228 +10,486 @@ import (
 )
 
 type UDPClient struct {
-	con         *net.UDPConn
-	Out         chan battleye.BEPacket        // to server
-	CmdIn       chan battleye.BEServerCommand // to client
-	MsgIn       chan battleye.BEServerMessage // to client
-	Err         chan error                    // error channel
-	chk         chan battleye.BEServerCommand // to pending processor
-	server      *net.UDPAddr
-	cmdCounter  byte
-	cmdMutex    *sync.Mutex
-	online      bool
-	onlineMutex *sync.Mutex
-	heartbeat   time.Time
-	cfg         *Config
+	con          *net.UDPConn
+	Out          chan battleye.BEPacket        // to server
+	CmdIn        chan Reply                    // to client
+	MsgIn        chan battleye.BEServerMessage // to client
+	Err          chan error                    // error channel
+	chk          chan battleye.BEServerCommand // to pending processor
+	req          chan *request                 // commands awaiting a reply
+	server       *net.UDPAddr
+	cmdCounter   byte
+	cmdMutex     *sync.Mutex
+	conMutex     *sync.Mutex
+	status       Status
+	subscribers  []chan StateChange
+	stateMutex   *sync.Mutex
+	heartbeat    time.Time
+	sessions     int
+	policies     map[string]Policy
+	priorities   map[string]Priority
+	metrics      Metrics
+	metricsMutex *sync.Mutex
+	drained      chan struct{} // closed once the processor has stopped
+	capture      *Capture
+	captureMutex *sync.Mutex
+	cfg          *Config
 }
 
+const (
+	DefaultCommandTimeout = 10 * time.Second
+	DefaultShutdownGrace  = 5 * time.Second
+)
+
 type Config struct {
-	Server string
-	Rconpw string
+	Server            string
+	Rconpw            string
+	ReassemblyTimeout int // seconds
+	BackoffMin        int // seconds
+	BackoffMax        int // seconds
+	ShutdownGrace     int // seconds to wait for pending commands on shutdown
+	MaxInflight       int // commands sent but not answered yet
+	RateLimit         int // commands sent per second, 0 is unlimited
 }
 
 func NewUDPClient(cfg *Config) *UDPClient {
-	return &UDPClient{
-		Out:         make(chan battleye.BEPacket, 10),
-		CmdIn:       make(chan battleye.BEServerCommand, 20),
-		MsgIn:       make(chan battleye.BEServerMessage, 20),
-		Err:         make(chan error),
-		chk:         make(chan battleye.BEServerCommand, 10),
-		cmdMutex:    &sync.Mutex{},
-		onlineMutex: &sync.Mutex{},
-		cfg:         cfg,
+	u := &UDPClient{
+		Out:          make(chan battleye.BEPacket, 10),
+		CmdIn:        make(chan Reply, 20),
+		MsgIn:        make(chan battleye.BEServerMessage, 20),
+		Err:          make(chan error),
+		chk:          make(chan battleye.BEServerCommand, 10),
+		req:          make(chan *request, 10),
+		cmdMutex:     &sync.Mutex{},
+		conMutex:     &sync.Mutex{},
+		stateMutex:   &sync.Mutex{},
+		policies:     make(map[string]Policy),
+		priorities:   make(map[string]Priority),
+		metricsMutex: &sync.Mutex{},
+		drained:      make(chan struct{}),
+		captureMutex: &sync.Mutex{},
+		cfg:          cfg,
 	}
+	for name, p := range DefaultPriorities {
+		u.priorities[name] = p
+	}
+	return u
+}
+
+// Run starts Listen and ProcessPendingPackets and returns once both have
+// stopped after ctx is done.
+func (u *UDPClient) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		u.ProcessPendingPackets(ctx)
+		wg.Done()
+	}()
+	go func() {
+		u.Listen(ctx)
+		wg.Done()
+	}()
+	wg.Wait()
 }
 
-func (u *UDPClient) Listen() {
+// Listen connects to the server and reads packets until ctx is done and
+// ProcessPendingPackets has drained the outgoing queue.
+func (u *UDPClient) Listen(ctx context.Context) {
 	var buf [4096]byte
-	var header battleye.BEHeader
 
-Reconnect:
+	go func() {
+		<-u.drained
+		u.drop()
+	}()
+	defer u.setState(Disconnected, nil)
+
 	for {
+		if u.stopped() {
+			return
+		}
+
 		// reset counters
 		u.cmdMutex.Lock()
 		u.cmdCounter = 0
+		u.sessions++
 		u.heartbeat = time.Now()
 		u.cmdMutex.Unlock()
 
-		u.onlineMutex.Lock()
-		u.online = true // todo: this is a hack... it should be false until proven
-		u.onlineMutex.Unlock()
-
 		// (re)connect
+		u.setState(Connecting, nil)
 		server, err := net.ResolveUDPAddr("udp", u.cfg.Server)
 		if err != nil {
-			u.Err <- err
-			return
+			u.report(ctx, err)
+			u.wait(err)
+			continue
 		}
 		u.server = server
 
-		u.con, err = net.DialUDP("udp", nil, u.server)
+		con, err := net.DialUDP("udp", nil, u.server)
 		if err != nil {
-			u.Err <- err
-			time.Sleep(15 * time.Second)
+			u.report(ctx, err)
+			u.wait(err)
 			continue
 		}
-
-		// read deadline
-		u.con.SetReadDeadline(time.Now().Add(15 * time.Second))
+		u.conMutex.Lock()
+		u.con = con
+		u.conMutex.Unlock()
+		if u.stopped() {
+			u.drop()
+			return
+		}
 
 		// login
+		u.setState(Authenticating, nil)
+		con.SetReadDeadline(time.Now().Add(15 * time.Second))
 		newPacket := battleye.NewBEClientLogin()
 		newPacket.Password = u.cfg.Rconpw
-		u.Out <- newPacket
+		select {
+		case u.Out <- newPacket:
+		case <-u.drained:
+		}
 
 		// listen for incoming packets
-		for {
-			n, addr, err := u.con.ReadFromUDP(buf[:])
-			u.con.SetReadDeadline(time.Now().Add(45 * time.Second))
-			u.onlineMutex.Lock()
-			online := u.online
-			if !online {
-				err = fmt.Errorf("not online anymore")
-			}
-			u.onlineMutex.Unlock()
-			if err != nil || !online {
-				u.Err <- err
-				u.con.Close()
-				continue Reconnect
+		err = u.read(ctx, con, buf[:])
+		u.drop()
+		if u.stopped() {
+			return
+		}
+		if u.State() == AuthFailed {
+			// a wrong password will not fix itself quickly
+			u.report(ctx, err)
+			u.retry(u.maxBackoff())
+			continue
+		}
+		u.report(ctx, err)
+		u.wait(err)
+	}
+}
+
+// stopped reports whether the processor has shut down.
+func (u *UDPClient) stopped() bool {
+	select {
+	case <-u.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// read handles incoming packets until the connection fails.
+func (u *UDPClient) read(ctx context.Context, con *net.UDPConn, buf []byte) error {
+	var messages Window
+	for {
+		n, addr, err := con.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if u.State() == Online {
+			con.SetReadDeadline(time.Now().Add(45 * time.Second))
+		}
+		if addr.String() != u.server.String() {
+			continue
+		}
+		u.record(battleye.FromServer, con, buf[:n])
+		decoded, err := battleye.Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch packet := decoded.(type) {
+		case *battleye.BEServerLogin:
+			if packet.LoginResponse == 1 {
+				con.SetReadDeadline(time.Now().Add(45 * time.Second))
+				u.setState(Online, nil)
 			} else {
-				if addr.String() == u.server.String() {
-					err = header.Unmarshal(buf[:n])
-					if err == nil {
-						crcCheck, _ := battleye.CRC32(buf[6:n])
-						//log.Printf("%x %x\n", crcCheck, header.Crc)
-						if !bytes.Equal(crcCheck, header.Crc) {
-							continue
-						}
-						switch {
-						case header.PacketType == 0:
-							// BE login packet
-							packet := battleye.NewBEServerLogin()
-							err := packet.Unmarshal(buf[:n])
-							if err == nil {
-								if packet.LoginResponse == 1 {
-									u.onlineMutex.Lock()
-									u.online = true
-									u.onlineMutex.Unlock()
-									u.Err <- fmt.Errorf("logged in")
-								} else {
-									u.Err <- fmt.Errorf("invalid password")
-									return
-								}
-							}
-						case header.PacketType == 1:
-							// BE command packet
-							packet := battleye.NewBEServerCommand()
-							err := packet.Unmarshal(buf[:n])
-							if err == nil {
-								//log.Println("new cmd", packet)
-								u.CmdIn <- *packet
-								u.chk <- *packet
-							}
-						case header.PacketType == 2:
-							// BE server message
-							packet := battleye.NewBEServerMessage()
-							err := packet.Unmarshal(buf[:n])
-							if err == nil {
-								u.MsgIn <- *packet
-								response := battleye.NewBEClientMessage()
-								response.Sequence = packet.Sequence
-								u.Out <- response
-							}
-						}
-					}
+				err = fmt.Errorf("invalid password")
+				u.setState(AuthFailed, err)
+				return err
+			}
+		case *battleye.BEServerCommand:
+			//log.Println("new cmd", packet)
+			select {
+			case u.chk <- *packet:
+			case <-u.drained:
+			}
+		case *battleye.BEServerMessage:
+			// the server resends messages until they are acknowledged,
+			// so duplicates are acknowledged again but not handled
+			if !messages.Add(packet.Sequence) {
+				select {
+				case u.MsgIn <- *packet:
+				case <-ctx.Done():
+					// nobody is listening anymore
 				}
 			}
+			response := battleye.NewBEClientMessage()
+			response.Sequence = packet.Sequence
+			select {
+			case u.Out <- response:
+			case <-u.drained:
+			}
 		}
 	}
 }
 
-func (u *UDPClient) ProcessPendingPackets() {
-	pending := make([]*[]byte, 256)
-	pendingRetries := make([]uint16, 256)
-	ticker := time.Tick(1 * time.Second)
-	beat := battleye.NewBEClientCommand()
-	beat.Command = ""
+// drop closes the current connection, which makes Listen reconnect.
+func (u *UDPClient) drop() {
+	u.conMutex.Lock()
+	defer u.conMutex.Unlock()
+	if u.con != nil {
+		u.con.Close()
+		u.con = nil
+	}
+}
+
+// write sends raw bytes over the current connection, if there is one.
+func (u *UDPClient) write(b []byte) error {
+	u.conMutex.Lock()
+	defer u.conMutex.Unlock()
+	if u.con == nil {
+		return fmt.Errorf("not connected")
+	}
+	_, err := u.con.Write(b)
+	if err == nil {
+		u.record(battleye.FromClient, u.con, b)
+	}
+	return err
+}
+
+// ProcessPendingPackets sends queued packets and retries commands until
+// they are answered or their policy gives up on them. Once ctx is done it
+// keeps going until everything queued has been answered or the shutdown
+// grace period is over.
+func (u *UDPClient) ProcessPendingPackets(ctx context.Context) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
 	fails := 0
+	replies := NewReassembler(time.Duration(u.cfg.ReassemblyTimeout) * time.Second)
+	q := newQueue(u.cfg.MaxInflight, u.cfg.RateLimit)
+	send := func(now time.Time) {
+		if u.State() != Online {
+			// keep commands until the connection is back
+			return
+		}
+		if session := u.session(); session != q.session {
+			q.requeue()
+			q.session = session
+			replies = NewReassembler(replies.Window)
+		}
+		for _, seq := range q.fill(u, now) {
+			replies.Forget(seq)
+		}
+	}
+	idle := func() bool {
+		return q.empty() && len(u.Out) == 0 && len(u.req) == 0
+	}
+
+	done := ctx.Done()
+	var draining <-chan time.Time
+	defer close(u.drained)
 	for {
 		select {
+		case <-done:
+			done = nil
+			grace := time.Duration(u.cfg.ShutdownGrace) * time.Second
+			if grace <= 0 {
+				grace = DefaultShutdownGrace
+			}
+			draining = time.After(grace)
+		case <-draining:
+			for _, r := range q.clear() {
+				u.finish(ctx, r, Reply{Err: fmt.Errorf("udp shutdown before command was answered (%s)", r.packet.Command)})
+			}
+			return
 		case p := <-u.Out:
-			bytes, err := p.Marshal()
-			if err == nil {
-				// check packet type
-				if bytes[7] == 0x01 {
-					// modify command sequence
-					u.cmdMutex.Lock()
-					if u.cmdCounter > 255 {
-						u.cmdCounter = 0
-					}
-					//u.Err <- fmt.Errorf("debug: packet sequence %x", u.cmdCounter)
-					bytes[8] = u.cmdCounter
-					u.cmdCounter += 1
-					u.cmdMutex.Unlock()
-					// recalculate crc32
-					newCRC, _ := battleye.CRC32(bytes[6:])
-					bytes[2] = newCRC[0]
-					bytes[3] = newCRC[1]
-					bytes[4] = newCRC[2]
-					bytes[5] = newCRC[3]
-					// add new packet to list of pending packets
-					pending[bytes[8]] = &bytes
-				} else {
-					u.con.Write(bytes)
-					//u.con.SetReadDeadline(time.Now().Add(30 * time.Second))
-				}
+			if cmd, ok := p.(*battleye.BEClientCommand); ok {
+				q.push(u.request(cmd), time.Now())
+			} else if bytes, err := p.Marshal(); err == nil {
+				u.write(bytes)
 			}
+		case r := <-u.req:
+			q.push(r, time.Now())
 		case x := <-u.chk:
-			// check whether this is a reply
-			// of nrcon to an issued command
-			for k, v := range pending {
-				if v != nil {
-					//log.Printf("%d %d", (*v)[8], x.Sequence)
-					if (*v)[8] == x.Sequence {
-						pending[k] = nil
-					}
+			reply, ok := replies.Add(x)
+			if !ok {
+				break
+			}
+			r := q.answer(x.Sequence)
+			switch {
+			case r == nil:
+				// late or unsolicited
+				u.deliver(ctx, *reply)
+			case r.heartbeat:
+				fails = 0
+			default:
+				fails = 0
+				u.finish(ctx, r, *reply)
+			}
+		case now := <-ticker.C:
+			for _, reply := range replies.Expire(now) {
+				if _, ok := q.inflight[reply.Sequence]; ok {
+					// the command is resent, the server answers in full again
+					replies.Forget(reply.Sequence)
+					continue
 				}
+				u.deliver(ctx, reply)
 			}
-		case <-ticker:
-			// process all pending packets
-			for k, v := range pending {
-				if v != nil {
-					if pendingRetries[k] < 5 {
-						pendingRetries[k] += 1
-						//log.Printf("(re)sending %x", *v)
-						u.con.Write(*v)
-						//u.con.SetReadDeadline(time.Now().Add(30 * time.Second))
-					} else {
-						u.Err <- fmt.Errorf("udp could not send packet in time (%x)", *pending[k])
-						fails++
-						pendingRetries[k] = 0
-						pending[k] = nil
-						if fails >= 5 {
-							fails = 0
-							u.Err <- fmt.Errorf("too many failed send attempts")
-							u.onlineMutex.Lock()
-							u.online = false
-							u.onlineMutex.Unlock()
-						}
-					}
+			online := u.State() == Online
+			for _, r := range q.retry(u, now, online) {
+				reason := fmt.Errorf("udp command not answered after %d attempts (%s)", r.attempts, r.packet.Command)
+				if r.attempts == 0 {
+					reason = fmt.Errorf("udp command could not be sent in time (%s)", r.packet.Command)
+				}
+				if r.heartbeat {
+					u.report(ctx, reason)
+				} else {
+					u.finish(ctx, r, Reply{Err: reason})
+				}
+				if r.attempts <= r.policy.Retries {
+					// only commands the server has ignored count as failure
+					continue
+				}
+				fails++
+				if fails >= 5 {
+					fails = 0
+					u.report(ctx, fmt.Errorf("too many failed send attempts"))
+					u.drop()
 				}
 			}
-			u.onlineMutex.Lock()
-			if u.online {
+			if online && draining == nil {
 				// send a heartbeat if no other commands have been issued since 30 seconds
+				u.cmdMutex.Lock()
 				diff := time.Since(u.heartbeat)
 				if diff >= 30*time.Second {
 					u.heartbeat = time.Now()
-					u.Out <- beat
+				}
+				u.cmdMutex.Unlock()
+				if diff >= 30*time.Second {
+					beat := battleye.NewBEClientCommand()
+					beat.Command = ""
+					r := u.request(beat)
+					r.heartbeat = true
+					q.push(r, now)
 				}
 			}
-			u.onlineMutex.Unlock()
 		}
+		send(time.Now())
+		u.publish(q.snapshot())
+		if draining != nil && idle() {
+			return
+		}
+	}
+}
+
+// finish hands the reply to a command to whoever has issued it.
+func (u *UDPClient) finish(ctx context.Context, r *request, reply Reply) {
+	reply.Command = r.packet.Command
+	if r.reply != nil {
+		select {
+		case r.reply <- reply:
+		case <-r.done:
+		}
+		return
+	}
+	select {
+	case u.CmdIn <- reply:
+	case <-ctx.Done():
+	}
+}
+
+// report hands an error to Err. After ctx is done errors nobody reads
+// anymore are dropped.
+func (u *UDPClient) report(ctx context.Context, err error) {
+	select {
+	case u.Err <- err:
+	case <-ctx.Done():
+		select {
+		case u.Err <- err:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// sequence stamps the next free command sequence number into a
+// marshalled command packet and recalculates its checksum.
+func (u *UDPClient) sequence(bytes []byte, busy map[byte]*request) byte {
+	u.cmdMutex.Lock()
+	seq := u.cmdCounter
+	for busy[seq] != nil {
+		seq++
+	}
+	u.cmdCounter = seq + 1
+	u.heartbeat = time.Now()
+	u.cmdMutex.Unlock()
+	bytes[8] = seq
+	// recalculate crc32
+	newCRC, _ := battleye.CRC32(bytes[6:])
+	bytes[2] = newCRC[0]
+	bytes[3] = newCRC[1]
+	bytes[4] = newCRC[2]
+	bytes[5] = newCRC[3]
+	return seq
+}
+
+// session returns the number of the current connection.
+func (u *UDPClient) session() int {
+	u.cmdMutex.Lock()
+	defer u.cmdMutex.Unlock()
+	return u.sessions
+}
+
+// deliver hands a reply nobody waits for to CmdIn.
+func (u *UDPClient) deliver(ctx context.Context, reply Reply) {
+	select {
+	case u.CmdIn <- reply:
+	case <-ctx.Done():
 	}
+}
+
+// Send issues a command and waits for its reply or for its policy to give
+// up. If ctx has no deadline, DefaultCommandTimeout applies.
+func (u *UDPClient) Send(ctx context.Context, command string) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCommandTimeout)
+		defer cancel()
+	}
+
+	packet := battleye.NewBEClientCommand()
+	packet.Command = command
+	r := u.request(packet)
+	r.reply = make(chan Reply, 1)
+	r.done = make(chan struct{})
+	defer u.release(r)
 
+	select {
+	case u.req <- r:
+	case <-u.drained:
+		return "", fmt.Errorf("udp client stopped (%s)", command)
+	case <-ctx.Done():
+		return "", fmt.Errorf("udp command timed out (%s): %v", command, ctx.Err())
+	}
+
+	select {
+	case reply := <-r.reply:
+		return reply.Response, reply.Err
+	case <-ctx.Done():
+		return "", fmt.Errorf("udp command timed out (%s): %v", command, ctx.Err())
+	}
+}
+
+// queue hands p to the processor unless it has already stopped.
+func (u *UDPClient) queue(p battleye.BEPacket) error {
+	select {
+	case u.Out <- p:
+		return nil
+	case <-u.drained:
+		return fmt.Errorf("udp client stopped")
+	}
+}
+
+// release stops reply delivery to r, the processor drops it.
+func (u *UDPClient) release(r *request) {
+	close(r.done)
 }
 
 func (u *UDPClient) KickPlayerById(id int16, reason string) error {
@@ -244,7 +502,31 @@ func (u *UDPClient) KickPlayerById(id int16, reason string) error {
 	}
 	newPacket.Command = cmd
 
-	u.Out <- newPacket
+	return u.queue(newPacket)
+}
+
+func (u *UDPClient) BanPlayerById(id int16, minutes int, reason string) error {
+	newPacket := battleye.NewBEClientCommand()
+	cmd := ""
+	if reason != "" {
+		cmd = fmt.Sprintf("ban %d %d %s", id, minutes, reason)
+	} else {
+		cmd = fmt.Sprintf("ban %d %d", id, minutes)
+	}
+	newPacket.Command = cmd
+
+	return u.queue(newPacket)
+}
+
+func (u *UDPClient) AddBan(guid string, minutes int, reason string) error {
+	newPacket := battleye.NewBEClientCommand()
+	cmd := ""
+	if reason != "" {
+		cmd = fmt.Sprintf("addBan %s %d %s", guid, minutes, reason)
+	} else {
+		cmd = fmt.Sprintf("addBan %s %d", guid, minutes)
+	}
+	newPacket.Command = cmd
 
-	return nil
+	return u.queue(newPacket)
 }
@@ -0,0 +1,247 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"ghosthunter/battleye"
+	"ghosthunter/emulator"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start runs a client against a fresh emulator and waits until it is
+// online. Errors and unsolicited replies are drained; server messages are
+// left on MsgIn.
+func start(t *testing.T, cfg emulator.Config) (*emulator.Server, *UDPClient, context.CancelFunc, chan struct{}) {
+	t.Helper()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.Password = "test"
+	server, err := emulator.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	go server.Run(serverCtx)
+	t.Cleanup(stopServer)
+
+	client := NewUDPClient(&Config{Server: server.Addr(), Rconpw: "test", ShutdownGrace: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			select {
+			case <-client.Err:
+			case <-client.CmdIn:
+			case <-client.drained:
+				return
+			}
+		}
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != Online {
+		if time.Now().After(deadline) {
+			t.Fatalf("client not online: %v", client.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server, client, cancel, stopped
+}
+
+func TestSend(t *testing.T) {
+	server, client, _, _ := start(t, emulator.Config{})
+	server.Reply("players", "Players on server:\n(0 players in total)")
+
+	response, err := client.Send(context.Background(), "players")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "Players on server:\n(0 players in total)" {
+		t.Errorf("got %q", response)
+	}
+	response, err = client.Send(context.Background(), "missions")
+	if err != nil || response != "Unknown command" {
+		t.Errorf("got %q, %v", response, err)
+	}
+}
+
+func TestSendMultipart(t *testing.T) {
+	server, client, _, _ := start(t, emulator.Config{MaxPayload: 16})
+	long := strings.Repeat("0123456789", 30)
+	server.Reply("bans", long)
+
+	response, err := client.Send(context.Background(), "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != long {
+		t.Errorf("got %q, want %q", response, long)
+	}
+}
+
+func TestLossAndDuplicates(t *testing.T) {
+	server, client, _, _ := start(t, emulator.Config{
+		MaxPayload:     16,
+		AckTimeout:     100 * time.Millisecond,
+		MessageRetries: 50,
+	})
+	client.SetPolicy("echo", Policy{Timeout: 20 * time.Second, Retries: 100, Interval: 100 * time.Millisecond})
+	server.Handle("echo", func(command string) string {
+		return strings.Repeat(strings.TrimPrefix(command, "echo "), 8)
+	})
+	server.SetFaults(emulator.Faults{Loss: 0.1, Duplicate: 0.3, Reorder: 0.2, Delay: 20 * time.Millisecond})
+
+	for i := 0; i < 10; i++ {
+		word := fmt.Sprintf("word%d ", i)
+		response, err := client.Send(context.Background(), "echo "+word)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != strings.Repeat(word, 8) {
+			t.Errorf("echo %d: got %q", i, response)
+		}
+	}
+
+	const messages = 10
+	for i := 0; i < messages; i++ {
+		server.Push(fmt.Sprintf("message %d", i))
+	}
+	seen := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(seen) < messages {
+		select {
+		case m := <-client.MsgIn:
+			if seen[m.Message] {
+				t.Errorf("%q delivered twice", m.Message)
+			}
+			seen[m.Message] = true
+		case <-timeout:
+			t.Fatalf("got %d of %d messages", len(seen), messages)
+		}
+	}
+	// resent messages still in flight must not come through again
+	select {
+	case m := <-client.MsgIn:
+		t.Errorf("unexpected %q", m.Message)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, client, cancel, stopped := start(t, emulator.Config{})
+	server.Silence(time.Minute)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Send(context.Background(), "players")
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not stop after the shutdown grace period")
+	}
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "shutdown") {
+			t.Errorf("got %v, want a shutdown error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send did not return")
+	}
+	ctx, done := context.WithTimeout(context.Background(), time.Second)
+	defer done()
+	if _, err := client.Send(ctx, "players"); err == nil {
+		t.Error("Send after shutdown succeeded")
+	}
+}
+
+func TestCaptureRedactsPassword(t *testing.T) {
+	dir := t.TempDir()
+	filename, pcap := filepath.Join(dir, "capture.log"), filepath.Join(dir, "capture.pcap")
+	server, err := emulator.New(emulator.Config{Addr: "127.0.0.1:0", Password: "hunter2secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	go server.Run(serverCtx)
+
+	client := NewUDPClient(&Config{Server: server.Addr(), Rconpw: "hunter2secret", ShutdownGrace: 1})
+	if err := client.StartCapture(filename, pcap); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(stopped)
+	}()
+	go func() {
+		for {
+			select {
+			case <-client.Err:
+			case <-client.CmdIn:
+			case <-client.drained:
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != Online {
+		if time.Now().After(deadline) {
+			t.Fatalf("client not online: %v", client.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+	client.StopCapture()
+
+	for _, name := range []string{filename, pcap} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("hunter2secret")) || bytes.Contains(data, []byte(hex.EncodeToString([]byte("hunter2secret")))) {
+			t.Errorf("%s contains the password", name)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logins := 0
+	for _, r := range records {
+		if packet, err := battleye.DecodeFrom(r.Direction, r.Packet); err != nil {
+			t.Errorf("captured packet does not decode: %v", err)
+		} else if _, ok := packet.(*battleye.BEClientLogin); ok {
+			logins++
+		}
+	}
+	if logins == 0 {
+		t.Error("login not captured")
+	}
+}
@@ -0,0 +1,34 @@
+package udp
+
+// Window remembers the sequence numbers of server messages received on
+// one connection so that resent messages can be told apart from new ones.
+// Sequence numbers wrap around, only the 128 numbers up to the newest one
+// count as received.
+type Window struct {
+	seen    [256]bool
+	latest  byte
+	started bool
+}
+
+// Add marks seq as received and reports whether it had been before.
+func (w *Window) Add(seq byte) (duplicate bool) {
+	if !w.started {
+		w.started = true
+		w.latest = seq
+		w.seen[seq] = true
+		return false
+	}
+	if w.latest-seq < 128 {
+		// not newer than the newest message, a late one or resent
+		duplicate = w.seen[seq]
+		w.seen[seq] = true
+		return duplicate
+	}
+	// forget what has been skipped since the previous lap
+	for s := w.latest + 1; s != seq; s++ {
+		w.seen[s] = false
+	}
+	w.latest = seq
+	w.seen[seq] = true
+	return false
+}
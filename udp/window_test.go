@@ -0,0 +1,52 @@
+package udp
+
+import "testing"
+
+func TestWindow(t *testing.T) {
+	type step struct {
+		seq       byte
+		duplicate bool
+	}
+	lap := func(from, to int) []step {
+		var steps []step
+		for s := from; s <= to; s++ {
+			steps = append(steps, step{byte(s), false})
+		}
+		return steps
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"resent", []step{{0, false}, {1, false}, {0, true}, {1, true}, {2, false}}},
+		{"late", []step{{0, false}, {2, false}, {1, false}, {1, true}}},
+		{"first message anywhere", []step{{200, false}, {201, false}, {200, true}}},
+		{
+			"across the wrap",
+			append(lap(250, 255+6), step{254, true}, step{255, true}, step{0, true}, step{5, true}, step{6, false}),
+		},
+		{
+			// numbers more than half a lap behind the newest are new again
+			"half window reuse",
+			append(lap(0, 129), step{2, true}, step{1, false}, step{1, true}, step{0, false}),
+		},
+		{
+			"skipped ahead",
+			[]step{{0, false}, {1, false}, {127, false}, {1, true}, {128, false}, {0, false}, {1, false}},
+		},
+		{
+			// a jump forgets the numbers it skips, a late one is new
+			"jump",
+			[]step{{10, false}, {11, false}, {130, false}, {10, true}, {129, false}, {129, true}},
+		},
+	}
+	for _, test := range tests {
+		var w Window
+		for i, s := range test.steps {
+			if got := w.Add(s.seq); got != s.duplicate {
+				t.Errorf("%s: step %d, sequence %d: got duplicate %v", test.name, i, s.seq, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"ghosthunter/geo"
+	"ghosthunter/players"
+	"strconv"
+	"strings"
+)
+
+// reason expands {asn} (as "AS<number>"), {org}, {id}, {name} and {guid}
+// in Reason for a player joining from a blocked network.
+func (v *VPNCheck) reason(p players.Player, asn geo.ASN) string {
+	return strings.NewReplacer(
+		"{asn}", "AS"+strconv.FormatUint(uint64(asn.Number), 10),
+		"{org}", asn.Organization,
+		"{id}", strconv.Itoa(p.ID),
+		"{name}", p.Name,
+		"{guid}", p.GUID,
+	).Replace(v.Reason)
+}
+
+// checkVPN looks the address of a player whose GUID is known up in the
+// blocklists and reports whether the player has been removed.
+func (s *Server) checkVPN(p players.Player, dryRun bool) bool {
+	config, _ := s.settings()
+	v := config.VPN
+	if s.blocked == nil || v.Action == "" || contains(v.Exempt, p.GUID) {
+		return false
+	}
+	var asn geo.ASN
+	if s.asn != nil {
+		var err error
+		if asn, err = s.asn.Lookup(p.IP); err != nil {
+			s.errors <- err
+		}
+	}
+	source, listed := s.blocked.Match(p.IP, asn.Number)
+	if !listed {
+		return false
+	}
+	s.log.Printf("blocklisted network (#%d %s %s AS%d %s, %s)", p.ID, p.Name, p.IP, asn.Number, asn.Organization, source)
+	return s.enforce("VPN", p, v.Action, v.reason(p, asn), 0, dryRun)
+}